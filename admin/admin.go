@@ -0,0 +1,186 @@
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/clixxa/dsp/bindings"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// REST endpoints over the campaign tables in ConfigDB, the bidders pick changes up on their next cycle.
+//
+//	GET, POST         /admin/folders
+//	GET, PUT, DELETE  /admin/folders/{id}
+//	GET, POST         /admin/creatives
+//	GET, PUT, DELETE  /admin/creatives/{id}
+//
+// It doesn't check who's asking, wrap it in services.RequireToken.
+type API struct {
+	BindingDeps bindings.BindingDeps
+	Prefix      string
+}
+
+const DefaultPrefix = "/admin/"
+
+// A folder as the api reads and writes it, Dimensions maps a type (eg Country) to the ids it's limited to
+type FolderDoc struct {
+	ID         int              `json:"id"`
+	OwnerID    int              `json:"owner"`
+	Budget     int              `json:"budget"`
+	CPC        int              `json:"cpc"`
+	Active     bool             `json:"active"`
+	CreativeID *int             `json:"creative"`
+	ParentID   *int             `json:"parent"`
+	Children   []int            `json:"children,omitempty"`
+	Dimensions map[string][]int `json:"dimensions"`
+}
+
+type CreativeDoc struct {
+	ID  int    `json:"id"`
+	URL string `json:"url"`
+}
+
+// Errors carrying the status to respond with
+type StatusErr struct {
+	Code int
+	Err  error
+}
+
+func (e StatusErr) Error() string {
+	return e.Err.Error()
+}
+
+func invalid(format string, args ...interface{}) error {
+	return StatusErr{http.StatusBadRequest, fmt.Errorf(format, args...)}
+}
+
+var NotFoundErr = StatusErr{http.StatusNotFound, errors.New("not found")}
+var MethodErr = StatusErr{http.StatusMethodNotAllowed, errors.New("method not allowed")}
+
+func (a *API) prefix() string {
+	if a.Prefix == "" {
+		return DefaultPrefix
+	}
+	return a.Prefix
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	res, err := a.route(r)
+	w.Header().Set(`Content-Type`, `application/json`)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if se, ok := err.(StatusErr); ok {
+			code = se.Code
+		} else {
+			a.BindingDeps.Logger.Println("admin err", r.Method, r.URL.Path, err.Error())
+		}
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if res == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// Splits /admin/{kind}/{id} by hand and hands off to the handler for the kind and method
+func (a *API) route(r *http.Request) (interface{}, error) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, a.prefix()), "/"), "/")
+	if len(parts) > 2 {
+		return nil, NotFoundErr
+	}
+	id := 0
+	if len(parts) == 2 {
+		var err error
+		if id, err = strconv.Atoi(parts[1]); err != nil || id <= 0 {
+			return nil, NotFoundErr
+		}
+	}
+
+	switch parts[0] {
+	case "folders":
+		switch {
+		case r.Method == "GET" && id == 0:
+			return a.ListFolders()
+		case r.Method == "GET":
+			return a.GetFolder(id)
+		case r.Method == "POST" && id == 0:
+			doc := &FolderDoc{}
+			if err := decode(r, doc); err != nil {
+				return nil, err
+			}
+			return a.SaveFolder(0, doc)
+		case r.Method == "PUT" && id != 0:
+			doc := &FolderDoc{}
+			if err := decode(r, doc); err != nil {
+				return nil, err
+			}
+			return a.SaveFolder(id, doc)
+		case r.Method == "DELETE" && id != 0:
+			return nil, a.DeleteFolder(id)
+		}
+		return nil, MethodErr
+	case "creatives":
+		switch {
+		case r.Method == "GET" && id == 0:
+			return a.ListCreatives()
+		case r.Method == "GET":
+			return a.GetCreative(id)
+		case r.Method == "POST" && id == 0:
+			doc := &CreativeDoc{}
+			if err := decode(r, doc); err != nil {
+				return nil, err
+			}
+			return a.SaveCreative(0, doc)
+		case r.Method == "PUT" && id != 0:
+			doc := &CreativeDoc{}
+			if err := decode(r, doc); err != nil {
+				return nil, err
+			}
+			return a.SaveCreative(id, doc)
+		case r.Method == "DELETE" && id != 0:
+			return nil, a.DeleteCreative(id)
+		}
+		return nil, MethodErr
+	}
+	return nil, NotFoundErr
+}
+
+func decode(r *http.Request, dest interface{}) error {
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20)).Decode(dest); err != nil {
+		return invalid("invalid json: %s", err.Error())
+	}
+	return nil
+}
+
+func (a *API) exists(query string, id int) (bool, error) {
+	var n int
+	if err := a.BindingDeps.ConfigDB.QueryRow(query, id).Scan(&n); err != nil {
+		a.BindingDeps.Debug.Println("err", err)
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Commits if fn succeeds, rolls back otherwise
+func (a *API) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := a.BindingDeps.ConfigDB.Begin()
+	if err != nil {
+		a.BindingDeps.Debug.Println("err", err)
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+const sqlFolderExists = `SELECT COUNT(*) FROM folders WHERE id = ?`
+const sqlCreativeExists = `SELECT COUNT(*) FROM creatives WHERE id = ?`
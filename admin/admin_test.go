@@ -0,0 +1,121 @@
+package admin
+
+import (
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/clixxa/dsp/bindings"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newAPI(t *testing.T) (*API, sqlmock.Sqlmock, func()) {
+	db, sqlm, _ := sqlmock.New()
+	l, fin := bindings.BufferedLogger(t)
+	return &API{BindingDeps: bindings.BindingDeps{ConfigDB: db, Logger: l, Debug: l}}, sqlm, fin
+}
+
+func count(n int) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"count"}).AddRow(n)
+}
+
+func call(a *API, method, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+func TestCreateFolder(t *testing.T) {
+	a, sqlm, fin := newAPI(t)
+	defer fin()
+
+	sqlm.ExpectQuery("FROM creatives").WithArgs(4).WillReturnRows(count(1))
+	sqlm.ExpectQuery("FROM folders").WithArgs(2).WillReturnRows(count(1))
+	sqlm.ExpectQuery("SELECT parent_folder_id").WithArgs(2).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	sqlm.ExpectBegin()
+	sqlm.ExpectExec("INSERT INTO folders").WithArgs(1, 1000, 50, "live").WillReturnResult(sqlmock.NewResult(9, 1))
+	sqlm.ExpectExec("DELETE FROM creative_folder").WithArgs(9).WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlm.ExpectExec("DELETE FROM parent_folder").WithArgs(9).WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlm.ExpectExec("DELETE FROM dimensions").WithArgs(9).WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlm.ExpectExec("INSERT INTO creative_folder").WithArgs(9, 4).WillReturnResult(sqlmock.NewResult(0, 1))
+	sqlm.ExpectExec("INSERT INTO parent_folder").WithArgs(2, 9).WillReturnResult(sqlmock.NewResult(0, 1))
+	sqlm.ExpectExec("INSERT INTO dimensions").WithArgs(9, 3, "Country").WillReturnResult(sqlmock.NewResult(0, 1))
+	sqlm.ExpectCommit()
+
+	rec := call(a, "POST", "/admin/folders", `{"owner": 1, "budget": 1000, "cpc": 50, "active": true, "creative": 4, "parent": 2, "dimensions": {"Country": [3]}}`)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"id":9`) {
+		t.Error("create failed", rec.Code, rec.Body.String())
+	}
+	if err := sqlm.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFolderValidation(t *testing.T) {
+	a, sqlm, fin := newAPI(t)
+	defer fin()
+
+	if rec := call(a, "POST", "/admin/folders", `{"dimensions": {"Planet": [3]}}`); rec.Code != 400 {
+		t.Error("unknown dimension accepted", rec.Code)
+	}
+
+	sqlm.ExpectQuery("FROM creatives").WithArgs(4).WillReturnRows(count(0))
+	if rec := call(a, "POST", "/admin/folders", `{"creative": 4}`); rec.Code != 400 || !strings.Contains(rec.Body.String(), "creative 4") {
+		t.Error("missing creative accepted", rec.Code, rec.Body.String())
+	}
+
+	// 5 is under 7 which is under 3, so 3 can't go under 5
+	sqlm.ExpectQuery("FROM folders").WithArgs(3).WillReturnRows(count(1))
+	sqlm.ExpectQuery("FROM folders").WithArgs(5).WillReturnRows(count(1))
+	sqlm.ExpectQuery("SELECT parent_folder_id").WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	sqlm.ExpectQuery("SELECT parent_folder_id").WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	if rec := call(a, "PUT", "/admin/folders/3", `{"parent": 5}`); rec.Code != 400 || !strings.Contains(rec.Body.String(), "cycle") {
+		t.Error("cycle accepted", rec.Code, rec.Body.String())
+	}
+
+	sqlm.ExpectQuery("FROM folders").WithArgs(3).WillReturnRows(count(1))
+	sqlm.ExpectQuery("FROM parent_folder").WithArgs(3).WillReturnRows(count(2))
+	if rec := call(a, "DELETE", "/admin/folders/3", ``); rec.Code != 409 {
+		t.Error("deleted a folder with children", rec.Code)
+	}
+
+	if err := sqlm.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreatives(t *testing.T) {
+	a, sqlm, fin := newAPI(t)
+	defer fin()
+
+	if rec := call(a, "POST", "/admin/creatives", `{"url": "http://x.com/?a={nope}"}`); rec.Code != 400 {
+		t.Error("unknown macro accepted", rec.Code)
+	}
+
+	sqlm.ExpectExec("INSERT INTO creatives").WithArgs("http://x.com/?b={brand}").WillReturnResult(sqlmock.NewResult(12, 1))
+	if rec := call(a, "POST", "/admin/creatives", `{"url": "http://x.com/?b={brand}"}`); rec.Code != 200 || !strings.Contains(rec.Body.String(), `"id":12`) {
+		t.Error("create failed", rec.Code, rec.Body.String())
+	}
+
+	sqlm.ExpectQuery("FROM creatives").WithArgs(12).WillReturnRows(count(1))
+	sqlm.ExpectQuery("FROM creative_folder").WithArgs(12).WillReturnRows(count(1))
+	if rec := call(a, "DELETE", "/admin/creatives/12", ``); rec.Code != 409 {
+		t.Error("deleted a creative in use", rec.Code)
+	}
+
+	sqlm.ExpectQuery("FROM creatives").WithArgs(13).WillReturnRows(count(0))
+	if rec := call(a, "GET", "/admin/creatives/13", ``); rec.Code != 404 {
+		t.Error("expected a 404", rec.Code)
+	}
+	for _, path := range []string{"/admin/widgets", "/admin/creatives/x", "/admin/creatives/1/2"} {
+		if rec := call(a, "GET", path, ``); rec.Code != 404 {
+			t.Error("expected a 404 for", path, rec.Code)
+		}
+	}
+	if rec := call(a, "PATCH", "/admin/creatives/13", ``); rec.Code != 405 {
+		t.Error("expected a 405", rec.Code)
+	}
+
+	if err := sqlm.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,99 @@
+package admin
+
+import (
+	"errors"
+	"github.com/clixxa/dsp/bindings"
+	"net/http"
+)
+
+var CreativeInUseErr = StatusErr{http.StatusConflict, errors.New("creative is used by a folder")}
+
+// Lists every creative, including ones the bidders skip for having unknown macros
+func (a *API) ListCreatives() ([]*CreativeDoc, error) {
+	ids, err := bindings.AllIDs("creatives", a.BindingDeps)
+	if err != nil {
+		return nil, err
+	}
+	docs := []*CreativeDoc{}
+	for _, id := range ids {
+		cr := &bindings.Creative{ID: id}
+		if err := cr.Unmarshal(1, a.BindingDeps); err != nil {
+			return nil, err
+		}
+		docs = append(docs, &CreativeDoc{ID: cr.ID, URL: cr.RedirectUrl})
+	}
+	return docs, nil
+}
+
+func (a *API) GetCreative(id int) (*CreativeDoc, error) {
+	if found, err := a.exists(sqlCreativeExists, id); err != nil {
+		return nil, err
+	} else if !found {
+		return nil, NotFoundErr
+	}
+	cr := &bindings.Creative{ID: id}
+	if err := cr.Unmarshal(1, a.BindingDeps); err != nil {
+		return nil, err
+	}
+	return &CreativeDoc{ID: cr.ID, URL: cr.RedirectUrl}, nil
+}
+
+// Inserts the creative when id is 0, otherwise replaces its url. Urls with unknown macros are refused.
+func (a *API) SaveCreative(id int, doc *CreativeDoc) (*CreativeDoc, error) {
+	if doc.URL == "" {
+		return nil, invalid("url is required")
+	}
+	if _, err := bindings.ParseURLTemplate(doc.URL); err != nil {
+		return nil, invalid("invalid url: %s", err.Error())
+	}
+
+	if id == 0 {
+		res, err := a.BindingDeps.ConfigDB.Exec(sqlInsertCreative, doc.URL)
+		if err != nil {
+			a.BindingDeps.Debug.Println("err", err)
+			return nil, err
+		}
+		newID, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		id = int(newID)
+	} else {
+		if found, err := a.exists(sqlCreativeExists, id); err != nil {
+			return nil, err
+		} else if !found {
+			return nil, NotFoundErr
+		}
+		if _, err := a.BindingDeps.ConfigDB.Exec(sqlUpdateCreative, doc.URL, id); err != nil {
+			a.BindingDeps.Debug.Println("err", err)
+			return nil, err
+		}
+	}
+	doc.ID = id
+	a.BindingDeps.Logger.Println("admin saved creative", id)
+	return doc, nil
+}
+
+func (a *API) DeleteCreative(id int) error {
+	if found, err := a.exists(sqlCreativeExists, id); err != nil {
+		return err
+	} else if !found {
+		return NotFoundErr
+	}
+	if used, err := a.exists(sqlCreativeUsed, id); err != nil {
+		return err
+	} else if used {
+		return CreativeInUseErr
+	}
+	if _, err := a.BindingDeps.ConfigDB.Exec(sqlDeleteCreative, id); err != nil {
+		a.BindingDeps.Debug.Println("err", err)
+		return err
+	}
+	a.BindingDeps.Logger.Println("admin deleted creative", id)
+	return nil
+}
+
+const sqlCreativeUsed = `SELECT COUNT(*) FROM creative_folder WHERE creative_id = ?`
+const sqlInsertCreative = `INSERT INTO creatives (destination_url) VALUES (?)`
+const sqlUpdateCreative = `UPDATE creatives SET destination_url = ? WHERE id = ?`
+const sqlDeleteCreative = `DELETE FROM creatives WHERE id = ?`
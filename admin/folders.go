@@ -0,0 +1,200 @@
+package admin
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/clixxa/dsp/bindings"
+	"net/http"
+)
+
+// How deep the hierarchy is walked looking for cycles before giving up
+const maxFolderDepth = 100
+
+var HasChildrenErr = StatusErr{http.StatusConflict, errors.New("folder has children, move or delete them first")}
+
+func folderDoc(f *bindings.Folder) *FolderDoc {
+	doc := &FolderDoc{ID: f.ID, OwnerID: f.OwnerID, Budget: f.Budget, CPC: f.CPC, Active: f.Active, ParentID: f.ParentID, Children: f.Children, Dimensions: map[string][]int{}}
+	if len(f.Creative) > 0 {
+		doc.CreativeID = &f.Creative[0]
+	}
+	for typ, vals := range map[string][]int{"Vertical": f.Vertical, "Country": f.Country, "Brand": f.Brand, "Network": f.Network, "SubNetwork": f.SubNetwork, "NetworkType": f.NetworkType, "Gender": f.Gender, "DeviceType": f.DeviceType} {
+		if len(vals) > 0 {
+			doc.Dimensions[typ] = vals
+		}
+	}
+	return doc
+}
+
+func (a *API) ListFolders() ([]*FolderDoc, error) {
+	folders := bindings.Folders{}
+	if err := folders.Unmarshal(1, a.BindingDeps); err != nil {
+		return nil, err
+	}
+	docs := []*FolderDoc{}
+	for _, f := range folders {
+		docs = append(docs, folderDoc(f))
+	}
+	return docs, nil
+}
+
+func (a *API) GetFolder(id int) (*FolderDoc, error) {
+	if found, err := a.exists(sqlFolderExists, id); err != nil {
+		return nil, err
+	} else if !found {
+		return nil, NotFoundErr
+	}
+	f := &bindings.Folder{ID: id}
+	if err := f.Unmarshal(1, a.BindingDeps); err != nil {
+		return nil, err
+	}
+	return folderDoc(f), nil
+}
+
+// Checks the fields, that the creative and parent exist, and that the parent isn't id or below it
+func (a *API) validateFolder(id int, doc *FolderDoc) error {
+	if doc.CPC < 0 || doc.Budget < 0 {
+		return invalid("cpc and budget can't be negative")
+	}
+	for typ := range doc.Dimensions {
+		if err := (&bindings.Dimension{Type: typ}).Transfer(&bindings.Folder{}); err != nil {
+			return invalid("unknown dimension type %s", typ)
+		}
+	}
+	if doc.CreativeID != nil {
+		if found, err := a.exists(sqlCreativeExists, *doc.CreativeID); err != nil {
+			return err
+		} else if !found {
+			return invalid("creative %d doesn't exist", *doc.CreativeID)
+		}
+	}
+	if doc.ParentID == nil {
+		return nil
+	}
+	if found, err := a.exists(sqlFolderExists, *doc.ParentID); err != nil {
+		return err
+	} else if !found {
+		return invalid("parent folder %d doesn't exist", *doc.ParentID)
+	}
+	// walk up from the parent, reaching id means id would be its own ancestor
+	at := *doc.ParentID
+	for depth := 0; depth < maxFolderDepth; depth++ {
+		if at == id {
+			return invalid("folder %d can't be under %d, that makes a cycle", id, *doc.ParentID)
+		}
+		var parent int
+		err := a.BindingDeps.ConfigDB.QueryRow(sqlParentOf, at).Scan(&parent)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			a.BindingDeps.Debug.Println("err", err)
+			return err
+		}
+		at = parent
+	}
+	return invalid("folder hierarchy deeper than %d", maxFolderDepth)
+}
+
+// Inserts the folder when id is 0, otherwise replaces it along with its creative, parent and dimensions
+func (a *API) SaveFolder(id int, doc *FolderDoc) (*FolderDoc, error) {
+	if id != 0 {
+		if found, err := a.exists(sqlFolderExists, id); err != nil {
+			return nil, err
+		} else if !found {
+			return nil, NotFoundErr
+		}
+	}
+	if err := a.validateFolder(id, doc); err != nil {
+		return nil, err
+	}
+	status := "paused"
+	if doc.Active {
+		status = "live"
+	}
+
+	err := a.inTx(func(tx *sql.Tx) error {
+		if id == 0 {
+			res, err := tx.Exec(sqlInsertFolder, doc.OwnerID, doc.Budget, doc.CPC, status)
+			if err != nil {
+				return err
+			}
+			newID, err := res.LastInsertId()
+			if err != nil {
+				return err
+			}
+			id = int(newID)
+		} else if _, err := tx.Exec(sqlUpdateFolder, doc.OwnerID, doc.Budget, doc.CPC, status, id); err != nil {
+			return err
+		}
+
+		for _, q := range []string{sqlClearFolderCreative, sqlClearFolderParent, sqlClearFolderDimensions} {
+			if _, err := tx.Exec(q, id); err != nil {
+				return err
+			}
+		}
+		if doc.CreativeID != nil {
+			if _, err := tx.Exec(sqlInsertFolderCreative, id, *doc.CreativeID); err != nil {
+				return err
+			}
+		}
+		if doc.ParentID != nil {
+			if _, err := tx.Exec(sqlInsertFolderParent, *doc.ParentID, id); err != nil {
+				return err
+			}
+		}
+		for typ, vals := range doc.Dimensions {
+			for _, val := range vals {
+				if _, err := tx.Exec(sqlInsertDimension, id, val, typ); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		a.BindingDeps.Debug.Println("err", err)
+		return nil, err
+	}
+	doc.ID = id
+	a.BindingDeps.Logger.Println("admin saved folder", id)
+	return doc, nil
+}
+
+// Refuses to orphan children, they have to be moved or deleted first
+func (a *API) DeleteFolder(id int) error {
+	if found, err := a.exists(sqlFolderExists, id); err != nil {
+		return err
+	} else if !found {
+		return NotFoundErr
+	}
+	if children, err := a.exists(sqlCountChildren, id); err != nil {
+		return err
+	} else if children {
+		return HasChildrenErr
+	}
+	err := a.inTx(func(tx *sql.Tx) error {
+		for _, q := range []string{sqlClearFolderCreative, sqlClearFolderParent, sqlClearFolderDimensions, sqlDeleteFolder} {
+			if _, err := tx.Exec(q, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		a.BindingDeps.Debug.Println("err", err)
+		return err
+	}
+	a.BindingDeps.Logger.Println("admin deleted folder", id)
+	return nil
+}
+
+const sqlParentOf = `SELECT parent_folder_id FROM parent_folder WHERE child_folder_id = ?`
+const sqlCountChildren = `SELECT COUNT(*) FROM parent_folder WHERE parent_folder_id = ?`
+const sqlInsertFolder = `INSERT INTO folders (user_id, budget, bid, status) VALUES (?, ?, ?, ?)`
+const sqlUpdateFolder = `UPDATE folders SET user_id = ?, budget = ?, bid = ?, status = ? WHERE id = ?`
+const sqlDeleteFolder = `DELETE FROM folders WHERE id = ?`
+const sqlClearFolderCreative = `DELETE FROM creative_folder WHERE folder_id = ?`
+const sqlClearFolderParent = `DELETE FROM parent_folder WHERE child_folder_id = ?`
+const sqlClearFolderDimensions = `DELETE FROM dimensions WHERE folder_id = ?`
+const sqlInsertFolderCreative = `INSERT INTO creative_folder (folder_id, creative_id) VALUES (?, ?)`
+const sqlInsertFolderParent = `INSERT INTO parent_folder (parent_folder_id, child_folder_id) VALUES (?, ?)`
+const sqlInsertDimension = `INSERT INTO dimensions (folder_id, dimensions_id, dimensions_type) VALUES (?, ?, ?)`
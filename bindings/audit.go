@@ -0,0 +1,284 @@
+package bindings
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entries written to the audit log, failures writing them and entries dropped with the queue full, served on /debug/vars
+var AuditMetrics = expvar.NewMap("audit")
+
+// Which bid requests go to the audit log, read as JSON from the ms/audit config key, eg
+//
+//	{"rate": 0.01, "ssp": {"7": 1}, "errors": true}
+//
+// rate is the fraction of requests kept, ssp overrides it per ssp and errors keeps every request that failed.
+type AuditSampling struct {
+	Rate   float64         `json:"rate"`
+	SSP    map[int]float64 `json:"ssp"`
+	Errors bool            `json:"errors"`
+}
+
+var InvalidRateErr = errors.New("audit rates must be between 0 and 1")
+
+func ParseAuditSampling(s string) (*AuditSampling, error) {
+	a := &AuditSampling{}
+	if s == "" {
+		return a, nil
+	}
+	if err := json.Unmarshal([]byte(s), a); err != nil {
+		return nil, err
+	}
+	rates := []float64{a.Rate}
+	for _, rate := range a.SSP {
+		rates = append(rates, rate)
+	}
+	for _, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return nil, InvalidRateErr
+		}
+	}
+	return a, nil
+}
+
+// Whether a request from ssp should be written, failed ones are kept when Errors is set
+func (a *AuditSampling) Sample(ssp int, failed bool) bool {
+	if a == nil {
+		return false
+	}
+	if failed && a.Errors {
+		return true
+	}
+	rate := a.Rate
+	if sspRate, found := a.SSP[ssp]; found {
+		rate = sspRate
+	}
+	return rate > 0 && rand.Float64() < rate
+}
+
+// One line of the audit log. ID is the ssp's request id and BidIDs the ids we bid with, one recall id per impression.
+type AuditEntry struct {
+	Time       time.Time              `json:"time"`
+	ID         string                 `json:"id"`
+	BidIDs     []string               `json:"bid_ids,omitempty"`
+	SspID      int                    `json:"ssp"`
+	Body       string                 `json:"body"`
+	Dimensions interface{}            `json:"dimensions"`
+	Rejections map[int]map[int]string `json:"rejections,omitempty"`
+	Status     int                    `json:"status"`
+	Response   string                 `json:"response,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+const DefaultAuditBytes = 64 << 20
+const DefaultAuditFiles = 20
+const DefaultAuditQueue = 1024
+
+// Writes entries as NDJSON to audit-{time}.ndjson files in Dir. A new file is started once the current one
+// reaches MaxBytes and only the newest MaxFiles are kept. Enqueue hands entries to a single writer
+// goroutine holding up to Queue of them, so the bid path never waits on the disk.
+type AuditLog struct {
+	Dir      string
+	MaxBytes int64
+	MaxFiles int
+	Queue    int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+
+	startOnce sync.Once
+	queueMu   sync.RWMutex
+	queue     chan *AuditEntry
+	closed    bool
+	drained   chan struct{}
+}
+
+func (l *AuditLog) start() {
+	l.startOnce.Do(func() {
+		size := l.Queue
+		if size <= 0 {
+			size = DefaultAuditQueue
+		}
+		l.queue, l.drained = make(chan *AuditEntry, size), make(chan struct{})
+		go func() {
+			defer close(l.drained)
+			for entry := range l.queue {
+				// failures are counted in AuditMetrics, there's no one left to return them to
+				l.Write(entry)
+			}
+		}()
+	})
+}
+
+// Queues entry for the writer without blocking, it's dropped when the queue is full or the log closed
+func (l *AuditLog) Enqueue(entry *AuditEntry) bool {
+	l.start()
+	l.queueMu.RLock()
+	defer l.queueMu.RUnlock()
+	if !l.closed {
+		select {
+		case l.queue <- entry:
+			return true
+		default:
+		}
+	}
+	AuditMetrics.Add("dropped", 1)
+	return false
+}
+
+func (l *AuditLog) Write(entry *AuditEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		AuditMetrics.Add("errors", 1)
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	max := l.MaxBytes
+	if max <= 0 {
+		max = DefaultAuditBytes
+	}
+	if l.file == nil || l.size+int64(len(b)) > max {
+		if err := l.rotate(); err != nil {
+			AuditMetrics.Add("errors", 1)
+			return err
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		AuditMetrics.Add("errors", 1)
+		return err
+	}
+	AuditMetrics.Add("entries", 1)
+	return nil
+}
+
+// Starts a new file and removes the oldest ones past MaxFiles
+func (l *AuditLog) rotate() error {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	name := filepath.Join(l.Dir, "audit-"+time.Now().UTC().Format("20060102T150405.000000000")+".ndjson")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.file, l.size = f, 0
+
+	max := l.MaxFiles
+	if max <= 0 {
+		max = DefaultAuditFiles
+	}
+	files, err := AuditFiles(l.Dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > max {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+	return nil
+}
+
+// Writes out whatever is queued, then closes the current file
+func (l *AuditLog) Close() error {
+	l.start()
+	l.queueMu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	l.queueMu.Unlock()
+	<-l.drained
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// The audit files in dir, oldest first
+func AuditFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "audit-*.ndjson"))
+	sort.Strings(files)
+	return files, err
+}
+
+// Copies the entries whose request or bid id is id to w, paths can be files or directories of them
+func SearchAudit(id string, paths []string, w io.Writer) (int, error) {
+	found := 0
+	for _, path := range paths {
+		files := []string{path}
+		if info, err := os.Stat(path); err != nil {
+			return found, err
+		} else if info.IsDir() {
+			if files, err = AuditFiles(path); err != nil {
+				return found, err
+			}
+		}
+		for _, name := range files {
+			n, err := searchAuditFile(id, name, w)
+			found += n
+			if err != nil {
+				return found, err
+			}
+		}
+	}
+	return found, nil
+}
+
+func searchAuditFile(id, name string, w io.Writer) (int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	found := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for scanner.Scan() {
+		var ids struct {
+			ID     string   `json:"id"`
+			BidID  string   `json:"bid_id"`
+			BidIDs []string `json:"bid_ids"`
+		}
+		// a line cut short by a crash isn't worth failing the search over
+		if json.Unmarshal(scanner.Bytes(), &ids) != nil {
+			continue
+		}
+		// entries from before multiple impressions had a single bid_id
+		matched := ids.ID == id || ids.BidID == id
+		for _, bid := range ids.BidIDs {
+			matched = matched || bid == id
+		}
+		if matched {
+			found++
+			if _, err := w.Write(append(scanner.Bytes(), '\n')); err != nil {
+				return found, err
+			}
+		}
+	}
+	return found, scanner.Err()
+}
@@ -0,0 +1,96 @@
+package bindings
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAuditSampling(t *testing.T) {
+	var unset *AuditSampling
+	if unset.Sample(1, true) {
+		t.Error("nil sampling shouldn't keep anything")
+	}
+	a, err := ParseAuditSampling(`{"rate": 0, "ssp": {"7": 1}, "errors": true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Sample(1, false) || !a.Sample(1, true) || !a.Sample(7, false) {
+		t.Error("wrong sampling", a)
+	}
+	for _, bad := range []string{`{"rate": 2}`, `{"ssp": {"7": -1}}`, `{`} {
+		if _, err := ParseAuditSampling(bad); err == nil {
+			t.Error("expected an error for", bad)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// each entry is over 100 bytes so every write starts a new file
+	l := &AuditLog{Dir: dir, MaxBytes: 100, MaxFiles: 3}
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if err := l.Write(&AuditEntry{ID: id, BidIDs: []string{"bid-" + id}, Body: `{"id":"` + id + `"}`, Status: 204}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+	files, _ := AuditFiles(dir)
+	if len(files) != 3 {
+		t.Error("old files not removed", files)
+	}
+
+	out := &bytes.Buffer{}
+	if n, err := SearchAudit("bid-d", []string{dir}, out); err != nil || n != 1 || !strings.Contains(out.String(), `"id":"d"`) {
+		t.Error("didn't find by bid id", n, err, out.String())
+	}
+	if n, _ := SearchAudit("a", []string{dir}, out); n != 0 {
+		t.Error("rotated out entry still found")
+	}
+	if n, _ := SearchAudit("e", files, out); n != 1 {
+		t.Error("didn't find by request id in files")
+	}
+}
+
+func TestAuditQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// holding the file lock stalls the writer, so a queue of 1 can't take all 3
+	l := &AuditLog{Dir: dir, Queue: 1}
+	l.mu.Lock()
+	queued := 0
+	for _, id := range []string{"a", "b", "c"} {
+		if l.Enqueue(&AuditEntry{ID: id}) {
+			queued++
+		}
+	}
+	l.mu.Unlock()
+	if queued == 3 {
+		t.Error("full queue didn't drop")
+	}
+	l.Close()
+	if l.Enqueue(&AuditEntry{ID: "d"}) {
+		t.Error("queued after close")
+	}
+
+	out := &bytes.Buffer{}
+	found := 0
+	for _, id := range []string{"a", "b", "c", "d"} {
+		n, _ := SearchAudit(id, []string{dir}, out)
+		found += n
+	}
+	if found != queued {
+		t.Error("queued entries not all written", found, queued)
+	}
+}
@@ -1,8 +1,10 @@
 package bindings
 
 import (
+	"bytes"
 	"crypto/cipher"
 	"encoding/base64"
+	"errors"
 	"golang.org/x/crypto/blowfish"
 	"strings"
 	//https://github.com/golang/go/blob/master/src/crypto/cipher/cbc.go
@@ -11,57 +13,71 @@ import (
 	//from https://talks.golang.org/2010/io/talk.pdf
 )
 
+var InvalidIVErr = errors.New("iv must be 8 bytes")
+var NotBlocksErr = errors.New("ciphertext is not a whole number of blocks")
+
+// Legacy Blowfish CBC tokens with a static IV and zero padding, only kept so old tokens can be read
 type B64 struct {
 	Key []byte
 	IV  []byte
 }
 
-func (b *B64) Encrypt(pt []byte) string {
-	key := b.Key
-	block, err := blowfish.NewCipher(key)
+// Checks the key and iv are usable, so bad keys are caught when loaded rather than per request
+func (b *B64) Validate() error {
+	_, err := b.mode()
+	return err
+}
+
+func (b *B64) mode() (cipher.Block, error) {
+	block, err := blowfish.NewCipher(b.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.IV) != blowfish.BlockSize {
+		return nil, InvalidIVErr
+	}
+	return block, nil
+}
+
+func (b *B64) Encrypt(pt []byte) (string, error) {
+	block, err := b.mode()
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
 	mode := cipher.NewCBCEncrypter(block, b.IV)
-	// padder := padding.NewPkcs5Padding()
-	// pt, err = padder.Pad(pt) // padd last block of plaintext if block size less than block cipher size
-	// if err != nil {
-	// 	panic(err.Error())
-	// }
-	r := 8 - (len(pt) % 8)
+	r := blowfish.BlockSize - (len(pt) % blowfish.BlockSize)
 	pt = append(pt, make([]byte, r)...)
 	ct := make([]byte, len(pt))
 	mode.CryptBlocks(ct, pt)
-	sEnc := base64.StdEncoding.EncodeToString([]byte(ct))
-	// log.Println("pre replace", sEnc)
+	sEnc := base64.StdEncoding.EncodeToString(ct)
 	sEnc = strings.Replace(sEnc, "+", "-", -1)
 	sEnc = strings.Replace(sEnc, "/", "_", -1)
 	sEnc = strings.Replace(sEnc, "=", ".", -1)
-	return sEnc
+	return sEnc, nil
 }
 
-func (b *B64) Decrypt(ct string) []byte {
-	key := b.Key
+// Decrypts and strips the zero padding, so plaintexts ending in zero bytes don't survive
+func (b *B64) Decrypt(ct string) ([]byte, error) {
 	ct = strings.Replace(ct, "-", "+", -1)
 	ct = strings.Replace(ct, "_", "/", -1)
 	ct = strings.Replace(ct, ".", "=", -1)
-	// log.Println("post replace", ct)
-	sDec, _ := base64.StdEncoding.DecodeString(ct)
-	block, err := blowfish.NewCipher(key)
+	sDec, err := base64.StdEncoding.DecodeString(ct)
+	if err != nil {
+		return nil, err
+	}
+	if len(sDec) == 0 || len(sDec)%blowfish.BlockSize != 0 {
+		return nil, NotBlocksErr
+	}
+	block, err := b.mode()
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 	mode := cipher.NewCBCDecrypter(block, b.IV)
 	pt := make([]byte, len(sDec))
 	mode.CryptBlocks(pt, sDec)
-
-	// log.Println("dump", pt)
-	// r := bytes.LastIndex(pt, []byte{0})
-	// log.Println("width", r)
-	// pt = pt[0:r]
-	return pt
+	return bytes.TrimRight(pt, "\x00"), nil
 }
 
-func (b *B64) GetCT(ct string) string {
+func (b *B64) GetCT(ct string) (string, error) {
 	return b.Encrypt([]byte(ct))
 }
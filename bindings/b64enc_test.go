@@ -8,13 +8,41 @@ func TestB64(t *testing.T) {
 	pt := []byte("Hello this is a test")
 
 	p := &B64{Key: []byte("hello"), IV: []byte("whatwhat")}
-	ct := p.Encrypt(pt)
+	ct, err := p.Encrypt(pt)
+	if err != nil {
+		t.Fatal(err)
+	}
 	t.Logf("Ciphertext: %s\n", ct)
 
 	sDec := "1Q_bm0NJ6agmxKY0gKvnPkjtQvc4u_lc"
 
-	recovered_pt := p.Decrypt(sDec)
+	recovered_pt, err := p.Decrypt(sDec)
+	if err != nil {
+		t.Fatal(err)
+	}
 	t.Logf("Recovered plaintext: %s\n", recovered_pt)
+
+	if roundtrip, err := p.Decrypt(ct); err != nil {
+		t.Error(err)
+	} else if string(roundtrip) != string(pt) {
+		t.Error("padding not stripped", roundtrip)
+	}
+}
+
+func TestB64Errors(t *testing.T) {
+	p := &B64{Key: []byte("hello"), IV: []byte("whatwhat")}
+	if _, err := p.Decrypt("not base64!"); err == nil {
+		t.Error("expected a base64 error")
+	}
+	if _, err := p.Decrypt("abcd"); err == nil {
+		t.Error("expected a block size error")
+	}
+	if _, err := (&B64{IV: []byte("whatwhat")}).Encrypt([]byte("a")); err == nil {
+		t.Error("expected a key error")
+	}
+	if _, err := (&B64{Key: []byte("hello"), IV: []byte("what")}).Encrypt([]byte("a")); err == nil {
+		t.Error("expected an iv error")
+	}
 }
 
 func TestCT(t *testing.T) {
@@ -0,0 +1,72 @@
+package bindings
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const DefaultBreakerThreshold = 5
+const DefaultBreakerCooldown = 30 * time.Second
+
+// Opens after Threshold consecutive failures and lets a single trial call through once Cooldown has passed.
+// Misses and SetNX collisions are answers from a healthy node, so they don't count as failures.
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func (b *Breaker) threshold() int {
+	if b.Threshold <= 0 {
+		return DefaultBreakerThreshold
+	}
+	return b.Threshold
+}
+
+func (b *Breaker) cooldown() time.Duration {
+	if b.Cooldown <= 0 {
+		return DefaultBreakerCooldown
+	}
+	return b.Cooldown
+}
+
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold() {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	// half open, hold the others off while this call tries the node
+	b.openUntil = now.Add(b.cooldown())
+	return true
+}
+
+func (b *Breaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil || err == RecallMissingErr || err == CantStoreErr {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold() {
+		b.openUntil = time.Now().Add(b.cooldown())
+	}
+}
+
+func (b *Breaker) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures >= b.threshold() {
+		return fmt.Sprintf(`breaker open, %d failures`, b.failures)
+	}
+	return fmt.Sprintf(`breaker closed, %d failures`, b.failures)
+}
@@ -0,0 +1,85 @@
+package bindings
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const clickTokenVersion = 1
+const clickTokenMacSize = 4
+
+var InvalidClickToken = errors.New("click token invalid")
+
+// What the {ct} macro encodes, enough to attribute a click or conversion without the recall
+type ClickToken struct {
+	RecallID   int
+	FolderID   int
+	CreativeID int
+	Time       time.Time
+}
+
+// Sealed tokens are version | recall | folder | creative | unix time, all varints.
+// Legacy tokens put a mac in front of that, as Blowfish alone doesn't detect tampering.
+func (c ClickToken) Encode(codec *TokenCodec) (string, error) {
+	payload := []byte{clickTokenVersion}
+	for _, v := range []int64{int64(c.RecallID), int64(c.FolderID), int64(c.CreativeID), c.Time.Unix()} {
+		payload = appendUvarint(payload, uint64(v))
+	}
+	return codec.Seal(payload)
+}
+
+func DecodeClickToken(codec *TokenCodec, ct string) (tok ClickToken, err error) {
+	payload, err := codec.Open(ct)
+	if err != nil {
+		return tok, err
+	}
+	if !IsSealedToken(ct) {
+		if len(payload) < clickTokenMacSize+1 {
+			return tok, InvalidClickToken
+		}
+		mac := payload[:clickTokenMacSize]
+		payload = payload[clickTokenMacSize:]
+		if !hmac.Equal(mac, clickTokenMac(codec.Legacy, payload)) {
+			return tok, InvalidClickToken
+		}
+	}
+	if len(payload) < 1 {
+		return tok, InvalidClickToken
+	}
+	if payload[0] != clickTokenVersion {
+		return tok, fmt.Errorf(`click token version %d not supported`, payload[0])
+	}
+
+	r := bytes.NewReader(payload[1:])
+	var vals [4]uint64
+	for n := range vals {
+		if vals[n], err = binary.ReadUvarint(r); err != nil {
+			return tok, InvalidClickToken
+		}
+	}
+	if r.Len() != 0 {
+		return tok, InvalidClickToken
+	}
+	tok.RecallID = int(vals[0])
+	tok.FolderID = int(vals[1])
+	tok.CreativeID = int(vals[2])
+	tok.Time = time.Unix(int64(vals[3]), 0)
+	return tok, nil
+}
+
+func clickTokenMac(b *B64, payload []byte) []byte {
+	mac := hmac.New(sha256.New, b.Key)
+	mac.Write(payload)
+	return mac.Sum(nil)[:clickTokenMacSize]
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
@@ -0,0 +1,32 @@
+package bindings
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClickTokenRoundTrip(t *testing.T) {
+	b := NewTokenCodec(&B64{Key: []byte("hello"), IV: []byte("whatwhat")})
+	tok := ClickToken{RecallID: 5276188924224580233, FolderID: 12, CreativeID: 340, Time: time.Unix(1500000000, 0)}
+	ct, err := tok.Encode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("token", ct)
+
+	out, err := DecodeClickToken(b, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != tok {
+		t.Error("decoded token differs", out, tok)
+	}
+
+	other := NewTokenCodec(&B64{Key: []byte("goodbye"), IV: []byte("whatwhat")})
+	if _, err := DecodeClickToken(other, ct); err == nil {
+		t.Error("token decoded with the wrong key")
+	}
+	if _, err := DecodeClickToken(b, "abc"); err == nil {
+		t.Error("garbage decoded")
+	}
+}
@@ -0,0 +1,89 @@
+package bindings
+
+import (
+	"time"
+)
+
+type Conversions struct {
+	Env      BindingDeps
+	SkipWork bool
+}
+
+// Inserts a conversion, duplicates (same recall and event) are ignored and flagged via dupLoc
+func (s Conversions) Save(f [4]interface{}, dupLoc *bool, errLoc *error) {
+	args := f[:]
+	s.Env.Debug.Printf(`would query %s with..`, sqlInsertConversion)
+	s.Env.Logger.Println("saving conversion", args)
+	if s.SkipWork {
+		return
+	}
+
+	res, e := s.Env.StatsDB.Exec(sqlInsertConversion, args...)
+	if e != nil {
+		*errLoc = e
+		s.Env.Logger.Println(`err saving conversion`, e.Error())
+		return
+	}
+	if n, e := res.RowsAffected(); e == nil && n == 0 {
+		*dupLoc = true
+	}
+}
+
+type CPARow struct {
+	FolderID    int     `json:"folder"`
+	Wins        int     `json:"wins"`
+	Spend       int     `json:"spend"`
+	Conversions int     `json:"conversions"`
+	Payout      int     `json:"payout"`
+	CPA         float64 `json:"cpa"`
+}
+
+// Spend and conversions per folder for purchases made between from and to
+func (s Conversions) Report(from, to time.Time, event string) ([]CPARow, error) {
+	rows, err := s.Env.StatsDB.Query(sqlReportCPA, from, to, event)
+	if err != nil {
+		s.Env.Debug.Println("err", err)
+		return nil, err
+	}
+	defer rows.Close()
+	report := []CPARow{}
+	for rows.Next() {
+		row := CPARow{}
+		if err := rows.Scan(&row.FolderID, &row.Wins, &row.Spend, &row.Conversions, &row.Payout); err != nil {
+			s.Env.Debug.Println("err", err)
+			return nil, err
+		}
+		if row.Conversions > 0 {
+			row.CPA = float64(row.Spend) / float64(row.Conversions)
+		}
+		report = append(report, row)
+	}
+	return report, rows.Err()
+}
+
+const sqlInsertConversion = `INSERT INTO conversions (recall_id, user_id, event, payout)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (recall_id, event) DO NOTHING
+`
+
+const sqlReportCPA = `SELECT p.folder_id, COUNT(*), COALESCE(SUM(p.rev_tx), 0), COALESCE(SUM(c.n), 0), COALESCE(SUM(c.payout), 0)
+	FROM purchases p
+	LEFT JOIN (
+		SELECT recall_id, COUNT(*) AS n, SUM(payout) AS payout FROM conversions
+		WHERE $3 = '' OR event = $3
+		GROUP BY recall_id
+	) c ON c.recall_id = p.recall_id
+	WHERE p.created_at >= $1 AND p.created_at < $2 AND p.recall_id != 0
+	GROUP BY p.folder_id
+	ORDER BY p.folder_id
+`
+
+const sqlCreateConversions = `CREATE TABLE conversions (
+	created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	recall_id bigint NOT NULL,
+	user_id int NOT NULL,
+	event varchar(64) NOT NULL,
+	payout int NOT NULL,
+
+	UNIQUE (recall_id, event)
+);`
@@ -1,11 +1,15 @@
 package bindings
 
 import (
+	"bytes"
+	"compress/flate"
 	"database/sql"
+	"encoding"
 	"encoding/json"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
+	"io/ioutil"
 	"log"
 	"strconv"
 	"strings"
@@ -18,6 +22,13 @@ type BindingDeps struct {
 	Logger     *log.Logger
 	DefaultKey string
 	Redis      *RandomCache
+
+	DefaultTokens   *TokenCodec
+	CompressRecalls bool
+	RecallTTLs      *RecallTTLs
+	Switches        *Switches
+	Audit           *AuditLog
+	AuditSampling   *AuditSampling
 }
 
 func tojson(i interface{}) string {
@@ -57,6 +68,9 @@ func (d *DSN) String() string {
 
 const sqlUserIPs = `SELECT ip FROM ip_histories WHERE user_id = ?`
 const sqlUser = `SELECT setting_id, value FROM user_settings WHERE user_id = ?`
+const settingAge = 5
+const settingKey = 6
+const settingKeyring = 7
 const sqlDimention = `SELECT dimentions_id, dimentions_type FROM dimentions WHERE folder_id = ?`
 const sqlDimension = `SELECT dimensions_id, dimensions_type FROM dimensions WHERE folder_id = ?`
 const sqlFolder = `SELECT budget, bid, creative_id, user_id, folders.status FROM folders LEFT JOIN creative_folder ON folder_id = id WHERE id = ?`
@@ -214,11 +228,13 @@ func (f *Users) Unmarshal(depth int, env BindingDeps) error {
 }
 
 type User struct {
-	ID  int
-	IPs []string
-	Age int
-	Key string
-	B64 *B64
+	ID      int
+	IPs     []string
+	Age     int
+	Key     string
+	Keyring string `json:"-"`
+	B64     *B64
+	Tokens  *TokenCodec `json:"-"`
 }
 
 func (u *User) Unmarshal(depth int, env BindingDeps) error {
@@ -250,25 +266,51 @@ func (u *User) Unmarshal(depth int, env BindingDeps) error {
 				return err
 			}
 			switch setting {
-			case 5:
+			case settingAge:
 				u.Age, _ = strconv.Atoi(value)
-			case 6:
+			case settingKey:
 				u.Key = value
+			case settingKeyring:
+				u.Keyring = value
 			}
 		}
 	}
 
-	s := strings.Split(env.DefaultKey, ":")
-	key, iv := s[0], s[1]
-	if u.Key != "" {
-		key = u.Key
+	u.Tokens = env.DefaultTokens
+	if env.DefaultTokens != nil {
+		u.B64 = env.DefaultTokens.Legacy
+		if u.Key != "" || u.Keyring != "" {
+			if err := u.ownTokens(env.DefaultTokens.Legacy.IV); err != nil {
+				env.Logger.Printf("user %d has unusable keys, using the defaults: %s", u.ID, err.Error())
+			}
+		}
 	}
-	u.B64 = &B64{Key: []byte(key), IV: []byte(iv)}
 
 	env.Debug.Printf("LOADED %s %T %s", wide(depth), u, tojson(u))
 	return nil
 }
 
+// Builds the user's own codec from their legacy key and keyring, leaving the defaults on error
+func (u *User) ownTokens(iv []byte) error {
+	legacy := u.B64
+	if u.Key != "" {
+		legacy = &B64{Key: []byte(u.Key), IV: iv}
+		if err := legacy.Validate(); err != nil {
+			return err
+		}
+	}
+	ring, err := ParseKeyring(u.Keyring)
+	if err != nil {
+		return err
+	}
+	if err := ring.Validate(); err != nil {
+		return err
+	}
+	u.B64 = legacy
+	u.Tokens = ring.Codec(legacy)
+	return nil
+}
+
 func AllIDs(table string, env BindingDeps) ([]int, error) {
 	rows, err := env.ConfigDB.Query(`SELECT id FROM ` + table)
 	if err != nil {
@@ -561,6 +603,10 @@ func (f *Creatives) Unmarshal(depth int, env BindingDeps) error {
 				env.Debug.Println("err", err)
 				return err
 			}
+			if ch.Template == nil {
+				CreativeMetrics.Add("invalid_url", 1)
+				continue
+			}
 			*f = append(*f, ch)
 		}
 	}
@@ -572,14 +618,22 @@ func (f *Creatives) Unmarshal(depth int, env BindingDeps) error {
 type Creative struct {
 	ID          int
 	RedirectUrl string
+	Template    *URLTemplate `json:"-"`
 }
 
+// Leaves Template nil when the url has macros we don't know, so the creative can be skipped
 func (c *Creative) Unmarshal(depth int, env BindingDeps) error {
 	row := env.ConfigDB.QueryRow(sqlCreative, c.ID)
 	if err := row.Scan(&c.RedirectUrl); err != nil {
 		env.Debug.Println("err", err)
 		return err
 	}
+	tmpl, err := ParseURLTemplate(c.RedirectUrl)
+	if err != nil {
+		env.Logger.Printf("creative %d won't be used: %s", c.ID, err.Error())
+		return nil
+	}
+	c.Template = tmpl
 	return nil
 }
 
@@ -603,6 +657,15 @@ func (StatsDB) allowFailure(sql string, db *sql.DB) {
 func (s StatsDB) Marshal(db *sql.DB) error {
 	log.Println("creating purchases table")
 	s.allowFailure(sqlCreatePurchases, db)
+	s.allowFailure(sqlAlterPurchasesRecall, db)
+	s.allowFailure(sqlIndexPurchasesRecall, db)
+	log.Println("creating conversions table")
+	s.allowFailure(sqlCreateConversions, db)
+	log.Println("creating orphan wins table")
+	s.allowFailure(sqlCreateOrphanWins, db)
+	log.Println("creating hourly rollups table")
+	s.allowFailure(sqlCreateRollups, db)
+	s.allowFailure(sqlIndexRollups, db)
 	return nil
 }
 
@@ -610,21 +673,45 @@ type Recalls struct {
 	Env BindingDeps
 }
 
-func (s Recalls) Save(f json.Marshaler, errLoc *error, idLoc *int) {
-	js, _ := f.MarshalJSON()
-	*idLoc, *errLoc = s.Env.Redis.FindID(string(js))
+// Compressed recalls start with this byte, which neither a binary nor a JSON recall can
+const flateRecall = 0xfc
+
+// Recalls live as long as the ssp may take to send the win notice
+func (s Recalls) Save(f encoding.BinaryMarshaler, ssp int, errLoc *error, idLoc *int) {
+	b, err := f.MarshalBinary()
+	if err != nil {
+		*errLoc = err
+		return
+	}
+	if s.Env.CompressRecalls {
+		buf := bytes.NewBuffer([]byte{flateRecall})
+		w, _ := flate.NewWriter(buf, flate.BestSpeed)
+		w.Write(b)
+		w.Close()
+		b = buf.Bytes()
+	}
+	*idLoc, *errLoc = s.Env.Redis.FindID(string(b), s.Env.RecallTTLs.For(ssp))
 }
 
-func (s Recalls) Fetch(f json.Unmarshaler, errLoc *error, recall string) {
+func (s Recalls) Fetch(f encoding.BinaryUnmarshaler, errLoc *error, recall string) {
 	target, err := s.Env.Redis.Load(recall)
 	if err != nil {
 		*errLoc = err
 		return
 	}
 
-	if e := f.UnmarshalJSON([]byte(target)); e != nil {
+	b := []byte(target)
+	if len(b) > 0 && b[0] == flateRecall {
+		if b, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(b[1:]))); err != nil {
+			*errLoc = err
+			s.Env.Logger.Println(`err inflating recall`, err.Error())
+			return
+		}
+	}
+
+	if e := f.UnmarshalBinary(b); e != nil {
 		*errLoc = e
-		s.Env.Logger.Println(`err saving recall`, e.Error())
+		s.Env.Logger.Println(`err loading recall`, e.Error())
 		return
 	}
 }
@@ -634,7 +721,7 @@ type Purchases struct {
 	SkipWork bool
 }
 
-func (s Purchases) Save(f [17]interface{}, errLoc *error) {
+func (s Purchases) Save(f [18]interface{}, errLoc *error) {
 	args := f[:]
 	s.Env.Debug.Printf(`would query %s with..`, sqlInsertPurchases)
 	s.Env.Logger.Println("saving purchases", args)
@@ -648,10 +735,14 @@ func (s Purchases) Save(f [17]interface{}, errLoc *error) {
 	}
 }
 
-const sqlInsertPurchases = `INSERT INTO purchases (sale_id, billable, rev_tx, rev_tx_home, rev_ssp, rev_ssp_home, ssp_id, folder_id, creative_id, country_id, vertical_id, brand_id, network_id, subnetwork_id, networktype_id, gender_id, devicetype_id)
-	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+const sqlInsertPurchases = `INSERT INTO purchases (sale_id, billable, rev_tx, rev_tx_home, rev_ssp, rev_ssp_home, ssp_id, folder_id, creative_id, country_id, vertical_id, brand_id, network_id, subnetwork_id, networktype_id, gender_id, devicetype_id, recall_id)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
 `
 
+const sqlAlterPurchasesRecall = `ALTER TABLE purchases ADD COLUMN recall_id bigint NOT NULL DEFAULT 0`
+
+const sqlIndexPurchasesRecall = `CREATE INDEX purchases_recall_id ON purchases (recall_id)`
+
 const sqlCreatePurchases = `CREATE TABLE purchases (
 	created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
 	sale_id int NOT NULL,
@@ -672,5 +763,7 @@ const sqlCreatePurchases = `CREATE TABLE purchases (
 	subnetwork_id int NOT NULL,
 	networktype_id int NOT NULL,
 	gender_id int NOT NULL,
-	devicetype_id int NOT NULL
+	devicetype_id int NOT NULL,
+
+	recall_id bigint NOT NULL DEFAULT 0
 );`
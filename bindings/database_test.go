@@ -0,0 +1,39 @@
+package bindings
+
+import (
+	"strconv"
+	"testing"
+)
+
+type rawRecall []byte
+
+func (r rawRecall) MarshalBinary() ([]byte, error) { return r, nil }
+
+func (r *rawRecall) UnmarshalBinary(d []byte) error {
+	*r = append((*r)[:0], d...)
+	return nil
+}
+
+func TestCompressedRecalls(t *testing.T) {
+	l, _ := BufferedLogger(t)
+	for _, compress := range []bool{false, true} {
+		mem := &MemoryCache{}
+		rec := Recalls{Env: BindingDeps{Logger: l, Redis: &RandomCache{CacheSystem: mem}, CompressRecalls: compress}}
+		var err error
+		var id int
+		rec.Save(rawRecall(`{"folder":1,"creative":2,"creative":2,"creative":2}`), 0, &err, &id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, _ := mem.Load(strconv.Itoa(id))
+		if compressed := stored[0] == flateRecall; compressed != compress {
+			t.Error("compression should be", compress)
+		}
+
+		got := rawRecall{}
+		rec.Fetch(&got, &err, strconv.Itoa(id))
+		if err != nil || string(got) != `{"folder":1,"creative":2,"creative":2,"creative":2}` {
+			t.Error("recall didn't survive", compress, err, string(got))
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package bindings
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Active keys seal and open, decrypt keys only open, retired keys are dropped entirely
+const (
+	KeyActive  = "active"
+	KeyDecrypt = "decrypt"
+	KeyRetired = "retired"
+)
+
+var NoActiveKeyErr = errors.New("keyring has no active key")
+
+type RingKey struct {
+	ID     byte
+	Status string
+	Secret []byte
+}
+
+// The configured token keys, written as comma separated id:status:hexsecret entries.
+// Id 0 is the key derived from the legacy key and takes no secret, "0:retired" stops accepting it.
+type Keyring struct {
+	Keys []*RingKey
+}
+
+func ParseKeyring(s string) (*Keyring, error) {
+	k := &Keyring{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf(`keyring entry %q should be id:status:secret`, entry)
+		}
+		id, err := strconv.ParseUint(parts[0], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf(`keyring entry %q has a bad id: %s`, entry, err.Error())
+		}
+		key := &RingKey{ID: byte(id), Status: parts[1]}
+		if len(parts) == 3 {
+			if key.Secret, err = hex.DecodeString(parts[2]); err != nil {
+				return nil, fmt.Errorf(`keyring key %d isn't hex: %s`, id, err.Error())
+			}
+		}
+		k.Keys = append(k.Keys, key)
+	}
+	return k, nil
+}
+
+func (k *Keyring) ByID(id byte) *RingKey {
+	for _, key := range k.Keys {
+		if key.ID == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// An empty keyring is valid and leaves only the derived key
+func (k *Keyring) Validate() error {
+	seen := map[byte]bool{}
+	active := 0
+	for _, key := range k.Keys {
+		if seen[key.ID] {
+			return fmt.Errorf(`keyring key %d listed twice`, key.ID)
+		}
+		seen[key.ID] = true
+
+		switch key.Status {
+		case KeyActive:
+			active++
+		case KeyDecrypt, KeyRetired:
+		default:
+			return fmt.Errorf(`keyring key %d has unknown status %q`, key.ID, key.Status)
+		}
+
+		if key.ID == DerivedKeyID {
+			if len(key.Secret) != 0 {
+				return fmt.Errorf(`keyring key %d is derived and can't have a secret`, key.ID)
+			}
+			continue
+		}
+		if key.Status == KeyRetired {
+			continue
+		}
+		switch len(key.Secret) {
+		case 16, 24, 32:
+		default:
+			return fmt.Errorf(`keyring key %d is %d bytes, needs 16, 24 or 32`, key.ID, len(key.Secret))
+		}
+	}
+	if len(k.Keys) > 0 && active != 1 {
+		if active == 0 {
+			return NoActiveKeyErr
+		}
+		return fmt.Errorf(`keyring has %d active keys, needs exactly 1`, active)
+	}
+	return nil
+}
+
+// A codec sealing with the active key and opening with any key that isn't retired
+func (k *Keyring) Codec(legacy *B64) *TokenCodec {
+	c := &TokenCodec{Keys: map[byte][]byte{}, Active: DerivedKeyID, Legacy: legacy}
+	derived := sha256.Sum256(legacy.Key)
+	c.Keys[DerivedKeyID] = derived[:]
+	for _, key := range k.Keys {
+		if key.Status == KeyRetired {
+			delete(c.Keys, key.ID)
+			continue
+		}
+		if key.ID != DerivedKeyID {
+			c.Keys[key.ID] = key.Secret
+		}
+		if key.Status == KeyActive {
+			c.Active = key.ID
+		}
+	}
+	return c
+}
+
+// Parses the key:iv format of TDEFAULTKEY, checking both will work with Blowfish
+func ParseLegacyKey(s string) (*B64, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return nil, errors.New("legacy key should be key:iv")
+	}
+	b := &B64{Key: []byte(s[:i]), IV: []byte(s[i+1:])}
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,75 @@
+package bindings
+
+import (
+	"testing"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	legacy := &B64{Key: []byte("hello"), IV: []byte("whatwhat")}
+
+	before, err := ParseKeyring("1:active:000102030405060708090a0b0c0d0e0f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := before.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	old, _ := before.Codec(legacy).Seal([]byte("old"))
+
+	after, _ := ParseKeyring("1:decrypt:000102030405060708090a0b0c0d0e0f, 2:active:101112131415161718191a1b1c1d1e1f")
+	if err := after.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c := after.Codec(legacy)
+	if c.Active != 2 {
+		t.Error("wrong active key", c.Active)
+	}
+	if pt, err := c.Open(old); err != nil || string(pt) != "old" {
+		t.Error("couldn't open token from the previous key", err)
+	}
+
+	retired, _ := ParseKeyring("1:retired,2:active:101112131415161718191a1b1c1d1e1f")
+	if err := retired.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := retired.Codec(legacy).Open(old); err == nil {
+		t.Error("opened a token from a retired key")
+	}
+
+	derived, _ := NewTokenCodec(legacy).Seal([]byte("derived"))
+	if pt, err := c.Open(derived); err != nil || string(pt) != "derived" {
+		t.Error("couldn't open token from the derived key", err)
+	}
+}
+
+func TestKeyringValidate(t *testing.T) {
+	for _, s := range []string{
+		"1:active:0001",
+		"1:active:000102030405060708090a0b0c0d0e0f,1:decrypt:000102030405060708090a0b0c0d0e0f",
+		"1:decrypt:000102030405060708090a0b0c0d0e0f",
+		"1:bogus:000102030405060708090a0b0c0d0e0f",
+		"0:active:000102030405060708090a0b0c0d0e0f",
+	} {
+		ring, err := ParseKeyring(s)
+		if err == nil {
+			err = ring.Validate()
+		}
+		if err == nil {
+			t.Error("expected an error for", s)
+		}
+	}
+	for _, s := range []string{"1:active:zz", "x:active", "1"} {
+		if _, err := ParseKeyring(s); err == nil {
+			t.Error("expected a parse error for", s)
+		}
+	}
+	if _, err := ParseLegacyKey("hello"); err == nil {
+		t.Error("expected an error for a key without iv")
+	}
+	if _, err := ParseLegacyKey("hello:short"); err == nil {
+		t.Error("expected an error for a short iv")
+	}
+	if b, err := ParseLegacyKey("hello:whatwhat"); err != nil || string(b.Key) != "hello" {
+		t.Error("couldn't parse legacy key", err)
+	}
+}
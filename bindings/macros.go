@@ -0,0 +1,120 @@
+package bindings
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Creatives skipped on each load because their url didn't parse, served on /debug/vars
+var CreativeMetrics = expvar.NewMap("creatives")
+
+type Macro struct {
+	Escape func(string) string
+	// left in the url when there's no value, so the ssp can fill it in
+	Passthrough bool
+}
+
+func noEscape(s string) string { return s }
+
+// Every macro a creative's redirect url may use
+var Macros = map[string]Macro{
+	`{network}`:        {Escape: url.QueryEscape},
+	`{subnetwork}`:     {Escape: url.QueryEscape},
+	`{realnetwork}`:    {Escape: url.QueryEscape},
+	`{realsubnetwork}`: {Escape: url.QueryEscape},
+	`{brand}`:          {Escape: url.QueryEscape},
+	`{brandurl}`:       {Escape: url.QueryEscape},
+	`{vertical}`:       {Escape: url.QueryEscape},
+	`{placement}`:      {Escape: url.QueryEscape},
+	`{country}`:        {Escape: url.QueryEscape},
+	`{devicetype}`:     {Escape: url.QueryEscape},
+	`{gender}`:         {Escape: url.QueryEscape},
+	`{guid}`:           {Escape: url.QueryEscape},
+	`{impid}`:          {Escape: url.QueryEscape},
+	`{ct}`:             {Escape: url.QueryEscape},
+	`{clickid}`:        {Escape: url.QueryEscape},
+	`{cpc}`:            {Escape: noEscape},
+	`{price}`:          {Escape: noEscape},
+
+	`${AUCTION_ID}`:       {Escape: url.QueryEscape, Passthrough: true},
+	`${AUCTION_BID_ID}`:   {Escape: url.QueryEscape, Passthrough: true},
+	`${AUCTION_IMP_ID}`:   {Escape: url.QueryEscape, Passthrough: true},
+	`${AUCTION_SEAT_ID}`:  {Escape: url.QueryEscape, Passthrough: true},
+	`${AUCTION_AD_ID}`:    {Escape: url.QueryEscape, Passthrough: true},
+	`${AUCTION_PRICE}`:    {Escape: noEscape, Passthrough: true},
+	`${AUCTION_CURRENCY}`: {Escape: url.QueryEscape, Passthrough: true},
+}
+
+// A redirect url split into literals and macros, so expanding doesn't rescan the string
+type URLTemplate struct {
+	Source string
+	parts  []templatePart
+}
+
+type templatePart struct {
+	literal string
+	macro   string
+}
+
+// Every {name} or ${NAME} has to be a known macro, a literal { is written {{, eg for json in the query string
+func ParseURLTemplate(s string) (*URLTemplate, error) {
+	t := &URLTemplate{Source: s}
+	rest, literal := s, ""
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			break
+		}
+		if strings.HasPrefix(rest[open:], `{{`) {
+			literal += rest[:open+1]
+			rest = rest[open+2:]
+			continue
+		}
+		start := open
+		if open > 0 && rest[open-1] == '$' {
+			start = open - 1
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf(`unterminated macro in %s`, s)
+		}
+		name := rest[start : open+end+1]
+		if _, found := Macros[name]; !found {
+			return nil, fmt.Errorf(`unknown macro %s in %s`, name, s)
+		}
+		if literal += rest[:start]; literal != "" {
+			t.parts = append(t.parts, templatePart{literal: literal})
+		}
+		t.parts = append(t.parts, templatePart{macro: name})
+		rest, literal = rest[open+end+1:], ""
+	}
+	if literal += rest; literal != "" {
+		t.parts = append(t.parts, templatePart{literal: literal})
+	}
+	return t, nil
+}
+
+// Replaces every macro with its escaped value, macros without a value are blanked unless they pass through
+func (t *URLTemplate) Expand(values map[string]string) string {
+	buf := bytes.NewBuffer(make([]byte, 0, len(t.Source)*2))
+	for _, part := range t.parts {
+		if part.macro == "" {
+			buf.WriteString(part.literal)
+			continue
+		}
+		macro := Macros[part.macro]
+		if v, found := values[part.macro]; found {
+			buf.WriteString(macro.Escape(v))
+		} else if macro.Passthrough {
+			buf.WriteString(part.macro)
+		}
+	}
+	return buf.String()
+}
+
+func (t *URLTemplate) String() string {
+	return t.Source
+}
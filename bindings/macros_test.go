@@ -0,0 +1,42 @@
+package bindings
+
+import (
+	"testing"
+)
+
+func TestURLTemplate(t *testing.T) {
+	tmpl, err := ParseURLTemplate(`http://x.com/{brand}?n={network}&again={network}&p=${AUCTION_PRICE}&b=${AUCTION_BID_ID}&g={gender}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := tmpl.Expand(map[string]string{
+		`{brand}`:           "some brand",
+		`{network}`:         "a&b",
+		`${AUCTION_BID_ID}`: "55",
+	})
+	want := `http://x.com/some+brand?n=a%26b&again=a%26b&p=${AUCTION_PRICE}&b=55&g=`
+	if out != want {
+		t.Errorf("expanded to %s, wanted %s", out, want)
+	}
+}
+
+func TestURLTemplateUnknown(t *testing.T) {
+	for _, s := range []string{`http://x.com/{nope}`, `http://x.com/${AUCTION_NOPE}`, `http://x.com/{brand`} {
+		if _, err := ParseURLTemplate(s); err == nil {
+			t.Error("expected an error for", s)
+		}
+	}
+	if tmpl, err := ParseURLTemplate(`http://x.com/plain`); err != nil || tmpl.Expand(nil) != `http://x.com/plain` {
+		t.Error("plain url mangled", err)
+	}
+}
+
+func TestURLTemplateEscape(t *testing.T) {
+	tmpl, err := ParseURLTemplate(`http://x.com/?j={{"c":"{country}"}#{{top}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := tmpl.Expand(map[string]string{`{country}`: "CA"}); out != `http://x.com/?j={"c":"CA"}#{top}` {
+		t.Error("wrong expansion", out)
+	}
+}
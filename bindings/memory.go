@@ -0,0 +1,190 @@
+package bindings
+
+import (
+	"container/list"
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cumulative recall cache counters, served on /debug/vars
+var RecallMetrics = expvar.NewMap("recalls")
+
+const DefaultMemoryEntries = 100000
+const DefaultMemoryTTL = 10 * time.Minute
+
+// A bounded in-process cache, evicting the least recently used entry once MaxEntries or MaxBytes is reached.
+// Store follows RecallRedis in refusing to overwrite a live key.
+type MemoryCache struct {
+	MaxEntries int
+	MaxBytes   int
+	TTL        time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	bytes int
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type memoryEntry struct {
+	key     string
+	val     string
+	expires time.Time
+}
+
+type MemoryStats struct {
+	Entries   int
+	Bytes     int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+func (m *MemoryCache) maxEntries() int {
+	if m.MaxEntries <= 0 {
+		return DefaultMemoryEntries
+	}
+	return m.MaxEntries
+}
+
+func (m *MemoryCache) ttl() time.Duration {
+	if m.TTL <= 0 {
+		return DefaultMemoryTTL
+	}
+	return m.TTL
+}
+
+// Must be called with mu held
+func (m *MemoryCache) lookup(keyStr string, now time.Time) *list.Element {
+	if m.items == nil {
+		m.ll = list.New()
+		m.items = map[string]*list.Element{}
+	}
+	el, found := m.items[keyStr]
+	if !found {
+		return nil
+	}
+	if now.After(el.Value.(*memoryEntry).expires) {
+		m.remove(el)
+		return nil
+	}
+	return el
+}
+
+func (m *MemoryCache) remove(el *list.Element) {
+	e := m.ll.Remove(el).(*memoryEntry)
+	delete(m.items, e.key)
+	m.bytes -= len(e.key) + len(e.val)
+}
+
+// Inserts or overwrites keyStr, then evicts from the back until within the limits.
+// A zero ttl (or one longer than TTL) uses TTL.
+func (m *MemoryCache) Set(keyStr string, val string, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setLocked(keyStr, val, ttl, time.Now())
+}
+
+// Set with mu already held
+func (m *MemoryCache) setLocked(keyStr string, val string, ttl time.Duration, now time.Time) {
+	if el := m.lookup(keyStr, now); el != nil {
+		m.remove(el)
+	}
+	if ttl <= 0 || ttl > m.ttl() {
+		ttl = m.ttl()
+	}
+	e := &memoryEntry{key: keyStr, val: val, expires: now.Add(ttl)}
+	m.items[keyStr] = m.ll.PushFront(e)
+	m.bytes += len(keyStr) + len(val)
+
+	for m.ll.Len() > m.maxEntries() || (m.MaxBytes > 0 && m.bytes > m.MaxBytes && m.ll.Len() > 1) {
+		m.remove(m.ll.Back())
+		atomic.AddUint64(&m.evictions, 1)
+		RecallMetrics.Add("memory_evictions", 1)
+	}
+}
+
+func (m *MemoryCache) Store(keyStr string, val string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if m.lookup(keyStr, now) != nil {
+		return CantStoreErr
+	}
+	m.setLocked(keyStr, val, ttl, now)
+	return nil
+}
+
+func (m *MemoryCache) Load(keyStr string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el := m.lookup(keyStr, time.Now())
+	if el == nil {
+		atomic.AddUint64(&m.misses, 1)
+		RecallMetrics.Add("memory_misses", 1)
+		return "", RecallMissingErr
+	}
+	m.ll.MoveToFront(el)
+	atomic.AddUint64(&m.hits, 1)
+	RecallMetrics.Add("memory_hits", 1)
+	return el.Value.(*memoryEntry).val, nil
+}
+
+// Counts are since the last dump, the cumulative ones are in RecallMetrics
+func (m *MemoryCache) Stats() MemoryStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := MemoryStats{Bytes: m.bytes, Hits: atomic.LoadUint64(&m.hits), Misses: atomic.LoadUint64(&m.misses), Evictions: atomic.LoadUint64(&m.evictions)}
+	if m.ll != nil {
+		s.Entries = m.ll.Len()
+	}
+	return s
+}
+
+// Hits and misses since the last dump, like RecallRedis
+func (m *MemoryCache) String() string {
+	s := m.Stats()
+	hits, misses := atomic.SwapUint64(&m.hits, 0), atomic.SwapUint64(&m.misses, 0)
+	evictions := atomic.SwapUint64(&m.evictions, 0)
+	rate := 0.0
+	if hits+misses > 0 {
+		rate = 100 * float64(hits) / float64(hits+misses)
+	}
+	return fmt.Sprintf(`memory cache %d entries (%d bytes), %d hits %d misses (%.1f%%), %d evictions since last dump`, s.Entries, s.Bytes, hits, misses, rate, evictions)
+}
+
+// Layers Memory in front of Backing, writes go to both and reads only reach Backing on a miss
+type WriteThrough struct {
+	Memory  *MemoryCache
+	Backing CacheSystem
+}
+
+func (w *WriteThrough) Store(keyStr string, val string, ttl time.Duration) error {
+	if err := w.Backing.Store(keyStr, val, ttl); err != nil {
+		return err
+	}
+	w.Memory.Set(keyStr, val, ttl)
+	return nil
+}
+
+func (w *WriteThrough) Load(keyStr string) (string, error) {
+	if val, err := w.Memory.Load(keyStr); err == nil {
+		return val, nil
+	}
+	val, err := w.Backing.Load(keyStr)
+	if err != nil {
+		return "", err
+	}
+	w.Memory.Set(keyStr, val, 0)
+	return val, nil
+}
+
+func (w *WriteThrough) String() string {
+	return w.Memory.String() + "\n" + w.Backing.String()
+}
@@ -0,0 +1,94 @@
+package bindings
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheLRU(t *testing.T) {
+	m := &MemoryCache{MaxEntries: 3}
+	for i := 0; i < 3; i++ {
+		if err := m.Store(strconv.Itoa(i), "v", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Store("0", "again", time.Minute); err != CantStoreErr {
+		t.Error("overwrote a live key", err)
+	}
+	// touch 0 so 1 is the least recently used
+	m.Load("0")
+	m.Store("3", "v", time.Minute)
+	if _, err := m.Load("1"); err != RecallMissingErr {
+		t.Error("1 should have been evicted", err)
+	}
+	for _, k := range []string{"0", "2", "3"} {
+		if _, err := m.Load(k); err != nil {
+			t.Error(k, "evicted", err)
+		}
+	}
+	if s := m.Stats(); s.Entries != 3 || s.Evictions != 1 || s.Misses != 1 {
+		t.Error("unexpected stats", s)
+	}
+	t.Log(m)
+	if s := m.Stats(); s.Hits != 0 {
+		t.Error("dump didn't reset hits", s)
+	}
+}
+
+func TestMemoryCacheConcurrentStore(t *testing.T) {
+	m := &MemoryCache{}
+	var stored int32
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if m.Store("k", strconv.Itoa(i), time.Minute) == nil {
+				atomic.AddInt32(&stored, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if stored != 1 {
+		t.Error("same key stored more than once", stored)
+	}
+}
+
+func TestMemoryCacheLimits(t *testing.T) {
+	m := &MemoryCache{MaxBytes: 9, TTL: 10 * time.Millisecond}
+	m.Set("a", "1234", 0)
+	m.Set("b", "1234", 0)
+	if _, err := m.Load("a"); err != RecallMissingErr {
+		t.Error("byte limit not enforced", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := m.Load("b"); err != RecallMissingErr {
+		t.Error("ttl not enforced", err)
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	backing := &mapCache{vals: map[string]string{}}
+	w := &WriteThrough{Memory: &MemoryCache{}, Backing: backing}
+	if err := w.Store("k", "v", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	calls := backing.calls
+	if v, err := w.Load("k"); err != nil || v != "v" {
+		t.Error("load failed", v, err)
+	}
+	if backing.calls != calls {
+		t.Error("hit went to the backing store")
+	}
+
+	backing.vals["other"] = "x"
+	if v, err := w.Load("other"); err != nil || v != "x" {
+		t.Error("miss not read through", v, err)
+	}
+	if v, err := w.Memory.Load("other"); err != nil || v != "x" {
+		t.Error("miss not cached", v, err)
+	}
+}
@@ -0,0 +1,108 @@
+package bindings
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Win notices received and those whose recall was gone, in total and per ssp, served on /debug/vars
+var WinMetrics = expvar.NewMap("wins")
+
+// INTEGRATION.txt gives ssps an hour to send the win notice
+const DefaultRecallTTL = time.Hour
+
+// How long recalls live, per ssp. Parsed from eg "1h,7:90m,12:2h" where the entry without an ssp is the default.
+type RecallTTLs struct {
+	Default time.Duration
+	BySSP   map[int]time.Duration
+}
+
+var InvalidTTLErr = errors.New("recall ttls must be positive")
+
+func ParseRecallTTLs(s string) (*RecallTTLs, error) {
+	r := &RecallTTLs{Default: DefaultRecallTTL, BySSP: map[int]time.Duration{}}
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		ssp, dur := "", entry
+		if i := strings.Index(entry, ":"); i >= 0 {
+			ssp, dur = entry[:i], entry[i+1:]
+		}
+		ttl, err := time.ParseDuration(dur)
+		if err != nil {
+			return nil, err
+		}
+		if ttl <= 0 {
+			return nil, InvalidTTLErr
+		}
+		if ssp == "" {
+			r.Default = ttl
+			continue
+		}
+		id, err := strconv.Atoi(ssp)
+		if err != nil {
+			return nil, fmt.Errorf(`invalid ssp %q in recall ttls`, ssp)
+		}
+		r.BySSP[id] = ttl
+	}
+	return r, nil
+}
+
+func (r *RecallTTLs) For(ssp int) time.Duration {
+	if r == nil {
+		return DefaultRecallTTL
+	}
+	if ttl, found := r.BySSP[ssp]; found {
+		return ttl
+	}
+	return r.Default
+}
+
+// The longest any recall can live, how long a replaced ring must still be read from
+func (r *RecallTTLs) Max() time.Duration {
+	max := r.For(0)
+	if r != nil {
+		for _, ttl := range r.BySSP {
+			if ttl > max {
+				max = ttl
+			}
+		}
+	}
+	return max
+}
+
+type OrphanWins struct {
+	Env      BindingDeps
+	SkipWork bool
+}
+
+// Records a win whose recall had expired (or never existed) with the raw query, so finance can reconcile it
+func (s OrphanWins) Save(f [5]interface{}, errLoc *error) {
+	args := f[:]
+	s.Env.Debug.Printf(`would query %s with..`, sqlInsertOrphanWin)
+	s.Env.Logger.Println("saving orphan win", args)
+	if s.SkipWork {
+		return
+	}
+
+	if _, e := s.Env.StatsDB.Exec(sqlInsertOrphanWin, args...); e != nil {
+		*errLoc = e
+		s.Env.Logger.Println(`err saving orphan win`, e.Error())
+	}
+}
+
+const sqlInsertOrphanWin = `INSERT INTO orphan_wins (recall_id, ssp_id, sale_id, rev_ssp, raw_query) VALUES ($1, $2, $3, $4, $5)`
+
+const sqlCreateOrphanWins = `CREATE TABLE orphan_wins (
+	created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	recall_id bigint NOT NULL,
+	ssp_id int NOT NULL,
+	sale_id bigint NOT NULL,
+	rev_ssp int NOT NULL,
+	raw_query text NOT NULL
+);`
@@ -0,0 +1,30 @@
+package bindings
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecallTTLs(t *testing.T) {
+	var unset *RecallTTLs
+	if unset.For(3) != DefaultRecallTTL || unset.Max() != DefaultRecallTTL {
+		t.Error("nil ttls should use the default")
+	}
+
+	r, err := ParseRecallTTLs("30m, 7:90m,12:2h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.For(1) != 30*time.Minute || r.For(7) != 90*time.Minute || r.Max() != 2*time.Hour {
+		t.Error("wrong ttls", r)
+	}
+	if r, _ := ParseRecallTTLs(""); r.For(7) != DefaultRecallTTL {
+		t.Error("empty config should use the default")
+	}
+
+	for _, bad := range []string{"1x", "a:1h", "7:-1m", "0s"} {
+		if _, err := ParseRecallTTLs(bad); err == nil {
+			t.Error("expected an error for", bad)
+		}
+	}
+}
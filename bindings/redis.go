@@ -4,66 +4,277 @@ import (
 	"errors"
 	"fmt"
 	"gopkg.in/redis.v5"
-	"hash/crc32"
-	"math/rand"
+	"hash/fnv"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type CacheSystem interface {
-	Store(string, string) error
+	Store(string, string, time.Duration) error
 	Load(string) (string, error)
 	String() string
 }
 
+// Allocates recall ids from IDs, or a randomly numbered instance if unset
 type RandomCache struct {
 	CacheSystem
+	IDs *Snowflake
 }
 
+var defaultIDs = RandomSnowflake()
+
 func (r *RandomCache) String() string {
 	return r.CacheSystem.String()
 }
 
-func (r *RandomCache) FindID(val string) (int, error) {
-	attempt := 0
-	for {
-		rec := int(rand.Int63())
-		if err := r.Store(strconv.Itoa(rec), val); err != nil && attempt > 5 {
-			return 0, err
-		} else if err == nil {
-			return rec, nil
-		}
-		attempt += 1
+// Stores val under a fresh id, ids are never reused so a failed store isn't retried
+func (r *RandomCache) FindID(val string, ttl time.Duration) (int, error) {
+	ids := r.IDs
+	if ids == nil {
+		ids = defaultIDs
 	}
+	rec := int(ids.Next())
+	if err := r.Store(strconv.Itoa(rec), val, ttl); err != nil {
+		return 0, err
+	}
+	return rec, nil
 }
 
+const DefaultVirtualNodes = 160
+
+// Spreads keys over Children with a consistent hash ring, so adding or removing a child only moves
+// the keys on its arc. Names identify children across rings (the redis url) and default to the index.
 type ShardSystem struct {
-	Children   []CacheSystem
-	Fallback   CacheSystem
-	totalCount uint64
+	Children     []CacheSystem
+	Names        []string
+	Weights      []int
+	VirtualNodes int
+	Fallback     CacheSystem
+
+	// the ring before the last change, read from on a miss until PreviousUntil
+	Previous      *ShardSystem
+	PreviousUntil time.Time
+
+	// each key is written to Replicas children, WriteQuorum of which must succeed
+	Replicas    int
+	WriteQuorum int
+
+	// children failing BreakerThreshold calls in a row are skipped for BreakerCooldown
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	ringOnce     sync.Once
+	points       []ringPoint
+	breakersOnce sync.Once
+	breakers     []*Breaker
+	totalCount   uint64
+}
+
+type ringPoint struct {
+	hash  uint64
+	child int
+}
+
+func (s *ShardSystem) Name(child int) string {
+	if child < len(s.Names) && s.Names[child] != "" {
+		return s.Names[child]
+	}
+	return strconv.Itoa(child)
+}
+
+func (s *ShardSystem) weight(child int) int {
+	if child < len(s.Weights) && s.Weights[child] > 0 {
+		return s.Weights[child]
+	}
+	return 1
 }
 
-func (s *ShardSystem) Store(keyStr string, val string) error {
+func (s *ShardSystem) ring() []ringPoint {
+	s.ringOnce.Do(func() {
+		vnodes := s.VirtualNodes
+		if vnodes <= 0 {
+			vnodes = DefaultVirtualNodes
+		}
+		for n := range s.Children {
+			name := s.Name(n)
+			for v := 0; v < vnodes*s.weight(n); v++ {
+				s.points = append(s.points, ringPoint{hash: ringHash(name + "#" + strconv.Itoa(v)), child: n})
+			}
+		}
+		sort.Slice(s.points, func(i, j int) bool { return s.points[i].hash < s.points[j].hash })
+	})
+	return s.points
+}
+
+// fnv-1a with a final mix, as fnv alone clusters short numeric keys
+func ringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Index of the child owning keyStr, the first point clockwise of its hash
+func (s *ShardSystem) pickIndex(keyStr string) int {
+	points := s.ring()
+	h := ringHash(keyStr)
+	i := sort.Search(len(points), func(i int) bool { return points[i].hash >= h })
+	if i == len(points) {
+		i = 0
+	}
+	return points[i].child
+}
+
+// A copy of the ring without its own history, so rings don't chain forever
+func (s *ShardSystem) WithoutHistory() *ShardSystem {
+	return &ShardSystem{Children: s.Children, Names: s.Names, Weights: s.Weights, VirtualNodes: s.VirtualNodes, Replicas: s.Replicas, WriteQuorum: s.WriteQuorum, BreakerThreshold: s.BreakerThreshold, BreakerCooldown: s.BreakerCooldown}
+}
+
+// Children in ring order starting at keyStr's position, each child once
+func (s *ShardSystem) walk(keyStr string) []int {
+	points := s.ring()
+	if len(points) == 0 {
+		return nil
+	}
+	h := ringHash(keyStr)
+	start := sort.Search(len(points), func(i int) bool { return points[i].hash >= h })
+	seen := make(map[int]bool, len(s.Children))
+	order := make([]int, 0, len(s.Children))
+	for i := 0; i < len(points) && len(order) < len(s.Children); i++ {
+		child := points[(start+i)%len(points)].child
+		if !seen[child] {
+			seen[child] = true
+			order = append(order, child)
+		}
+	}
+	return order
+}
+
+// Capped at the number of children, a key can't be on one twice
+func (s *ShardSystem) replicas() int {
+	if s.Replicas <= 0 {
+		return 1
+	}
+	if s.Replicas > len(s.Children) && len(s.Children) > 0 {
+		return len(s.Children)
+	}
+	return s.Replicas
+}
+
+// Defaults to a majority of the replicas
+func (s *ShardSystem) quorum() int {
+	if s.WriteQuorum > 0 {
+		return s.WriteQuorum
+	}
+	return s.replicas()/2 + 1
+}
+
+func (s *ShardSystem) breaker(child int) *Breaker {
+	s.breakersOnce.Do(func() {
+		s.breakers = make([]*Breaker, len(s.Children))
+		for n := range s.breakers {
+			s.breakers[n] = &Breaker{Threshold: s.BreakerThreshold, Cooldown: s.BreakerCooldown}
+		}
+	})
+	return s.breakers[child]
+}
+
+// The first Replicas children clockwise of keyStr whose breakers allow a call, open ones are skipped over
+func (s *ShardSystem) healthy(keyStr string) []int {
+	targets := make([]int, 0, s.replicas())
+	for _, child := range s.walk(keyStr) {
+		if len(targets) == s.replicas() {
+			break
+		}
+		if s.breaker(child).Allow() {
+			targets = append(targets, child)
+		}
+	}
+	return targets
+}
+
+// Writes to every healthy replica, succeeding once the quorum has stored it. Fewer healthy replicas
+// than the quorum fails without writing, a recall on fewer nodes than promised could be lost.
+func (s *ShardSystem) Store(keyStr string, val string, ttl time.Duration) error {
 	atomic.AddUint64(&s.totalCount, 1)
-	return s.Pick(keyStr).Store(keyStr, val)
+	targets := s.healthy(keyStr)
+	if len(targets) == 0 {
+		return NoHealthyShardsErr
+	}
+	quorum := s.quorum()
+	if len(targets) < quorum {
+		RecallMetrics.Add("quorum_unavailable", 1)
+		return QuorumUnavailableErr
+	}
+
+	errs := make([]error, len(targets))
+	if len(targets) == 1 {
+		errs[0] = s.Children[targets[0]].Store(keyStr, val, ttl)
+	} else {
+		wg := sync.WaitGroup{}
+		for n, child := range targets {
+			wg.Add(1)
+			go func(n, child int) {
+				defer wg.Done()
+				errs[n] = s.Children[child].Store(keyStr, val, ttl)
+			}(n, child)
+		}
+		wg.Wait()
+	}
+
+	stored := 0
+	var lastErr error
+	for n, err := range errs {
+		s.breaker(targets[n]).Record(err)
+		if err == nil {
+			stored++
+		} else {
+			lastErr = err
+		}
+	}
+	if stored >= quorum {
+		return nil
+	}
+	return lastErr
 }
 
+// The child primarily responsible for keyStr
 func (s *ShardSystem) Pick(keyStr string) CacheSystem {
-	key, err := strconv.Atoi(keyStr)
-	if err != nil {
-		key = int(crc32.ChecksumIEEE([]byte(keyStr)))
+	return s.Children[s.pickIndex(keyStr)]
+}
+
+// Reads from the first healthy replica that has the key
+func (s *ShardSystem) loadReplicas(keyStr string) (string, error) {
+	err := NoHealthyShardsErr
+	for _, child := range s.healthy(keyStr) {
+		var res string
+		res, err = s.Children[child].Load(keyStr)
+		s.breaker(child).Record(err)
+		if err == nil {
+			return res, nil
+		}
 	}
-	p := key % len(s.Children)
-	ch := s.Children[p]
-	fmt.Printf("keyStr %s (key %d) picked %d (%s)\n", keyStr, key, p, ch)
-	return ch
+	return "", err
 }
 
 func (s *ShardSystem) Load(keyStr string) (string, error) {
 	atomic.AddUint64(&s.totalCount, 1)
-	res, err := s.Pick(keyStr).Load(keyStr)
+	res, err := s.loadReplicas(keyStr)
+	if err != nil && s.Previous != nil && time.Now().Before(s.PreviousUntil) {
+		// only worth asking the old ring if the key lived somewhere else
+		if s.Previous.Name(s.Previous.pickIndex(keyStr)) != s.Name(s.pickIndex(keyStr)) {
+			res, err = s.Previous.loadReplicas(keyStr)
+		}
+	}
 	if err != nil && s.Fallback != nil {
 		res, err = s.Fallback.Load(keyStr)
 	}
@@ -75,23 +286,27 @@ func (s *ShardSystem) String() string {
 	if count == 0 {
 		return ""
 	}
-	str := []string{fmt.Sprintf("shard system counts (total %d)..", count)}
+	str := []string{fmt.Sprintf("shard system counts (total %d, replicas %d, quorum %d)..", count, s.replicas(), s.quorum())}
 	for i, child := range s.Children {
-		str = append(str, fmt.Sprintf(`child %d: %s`, i, child.String()))
+		str = append(str, fmt.Sprintf(`child %d (%s, %s): %s`, i, s.Name(i), s.breaker(i), child.String()))
 	}
 	return strings.Join(str, "\n")
 }
 
 var CantStoreErr = errors.New("redis returned not ok")
+var RecallMissingErr = errors.New("recall not found")
+var NoHealthyShardsErr = errors.New("no healthy shards")
+var QuorumUnavailableErr = errors.New("fewer healthy replicas than the write quorum")
 
+// Cmdable is a plain, sentinel failover or cluster client, see RedisConfig
 type RecallRedis struct {
-	*redis.Client
+	redis.Cmdable
 	calls uint64
 }
 
-func (r *RecallRedis) Store(keyStr string, val string) error {
+func (r *RecallRedis) Store(keyStr string, val string, ttl time.Duration) error {
 	atomic.AddUint64(&r.calls, 1)
-	res := r.SetNX(keyStr, val, 10*time.Minute)
+	res := r.SetNX(keyStr, val, ttl)
 	if err := res.Err(); err != nil {
 		return err
 	}
@@ -104,7 +319,9 @@ func (r *RecallRedis) Store(keyStr string, val string) error {
 func (r *RecallRedis) Load(keyStr string) (string, error) {
 	atomic.AddUint64(&r.calls, 1)
 	cmd := r.Get(keyStr)
-	if err := cmd.Err(); err != nil {
+	if err := cmd.Err(); err == redis.Nil {
+		return "", RecallMissingErr
+	} else if err != nil {
 		return "", err
 	}
 	return cmd.Result()
@@ -120,7 +337,7 @@ type CountingCache struct {
 	n        int
 }
 
-func (s *CountingCache) Store(keyStr string, val string) (err error) {
+func (s *CountingCache) Store(keyStr string, val string, ttl time.Duration) (err error) {
 	if s.Callback != nil {
 		_, err = s.Callback(s.n, []interface{}{keyStr, val})
 	}
@@ -3,23 +3,23 @@ package bindings
 import (
 	"fmt"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
-func TestRetryWithSharding(t *testing.T) {
+func TestFindIDWithSharding(t *testing.T) {
 	cb := func(n int, args interface{}) (string, error) {
 		t.Log(n, "called with", args)
 		switch n {
 		case 0:
-			fallthrough
+			return "", nil
 		case 1:
-			fallthrough
-		case 3:
 			return "", fmt.Errorf("failing %d", n)
 		case 2:
-			return "", nil
-		case 4:
 			return "test", nil
+		case 3:
+			return "", fmt.Errorf("failing %d", n)
 		default:
 			return "", fmt.Errorf("unhandled %d", n)
 		}
@@ -29,17 +29,21 @@ func TestRetryWithSharding(t *testing.T) {
 	an := &ShardSystem{Children: []CacheSystem{r}}
 	sh := &ShardSystem{Children: []CacheSystem{r, r}, Fallback: an}
 
-	rc1 := &RandomCache{an}
-	rc2 := &RandomCache{sh}
+	rc1 := &RandomCache{CacheSystem: an, IDs: &Snowflake{Instance: 3}}
+	rc2 := &RandomCache{CacheSystem: sh}
 
 	str := "test"
-	id, err := rc1.FindID(str)
+	id, err := rc1.FindID(str, time.Minute)
 	t.Log("recieved id and err", id, err)
 	if val, err := rc2.Load(strconv.Itoa(id)); err != nil {
 		t.Error(err)
 	} else if val != str {
 		t.Error("incorrect return val: " + val)
 	}
+
+	if _, err := rc1.FindID(str, time.Minute); err == nil || r.n != 4 {
+		t.Error("failed store should return without retrying", err, r.n)
+	}
 }
 
 func TestNonIntSharding(t *testing.T) {
@@ -49,7 +53,7 @@ func TestNonIntSharding(t *testing.T) {
 	}
 	r := &CountingCache{Callback: cb}
 	sh := &ShardSystem{Children: []CacheSystem{r, r}}
-	sh.Store("hello", "world")
+	sh.Store("hello", "world", time.Minute)
 	out, err := sh.Load("hello")
 	t.Log(err)
 	if out != "world" {
@@ -58,18 +62,169 @@ func TestNonIntSharding(t *testing.T) {
 }
 
 func TestPicks(t *testing.T) {
-	r1 := &CountingCache{}
-	r2 := &CountingCache{}
-	sh := &ShardSystem{Children: []CacheSystem{r1, r2, r2}}
-	p := sh.Pick("102")
-	t.Log(p)
-	if p != r1 {
-		t.Fail()
+	a, b, c := &CountingCache{}, &CountingCache{}, &CountingCache{}
+	names := []string{"a:6379", "b:6379", "c:6379"}
+	sh := &ShardSystem{Names: names, Children: []CacheSystem{a, b, c}}
+	if sh.Pick("102") != a || sh.Pick("hello") != c {
+		t.Error("keys moved off their known children, the ring changed")
+	}
+
+	// a fourth child takes about a quarter of the keys, and only from the others
+	more := &ShardSystem{Names: append(names, "d:6379"), Children: []CacheSystem{a, b, c, &CountingCache{}}}
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		if before, after := sh.pickIndex(key), more.pickIndex(key); before != after {
+			moved++
+			if after != 3 {
+				t.Fatal("key moved between old children", key, before, after)
+			}
+		}
+	}
+	if moved < 125 || moved > 375 {
+		t.Error("expected about 250 of 1000 keys to move", moved)
+	}
+}
+
+func TestRingRebalance(t *testing.T) {
+	names := []string{"a:6379", "b:6379", "c:6379"}
+	before := &ShardSystem{Names: names, Children: make([]CacheSystem, 3)}
+	after := &ShardSystem{Names: append(names, "d:6379"), Children: make([]CacheSystem, 4)}
+
+	const keys = 20000
+	moved := 0
+	counts := map[string]int{}
+	for i := 0; i < keys; i++ {
+		key := strconv.Itoa(i * 7919)
+		from, to := before.Name(before.pickIndex(key)), after.Name(after.pickIndex(key))
+		counts[to]++
+		if from != to {
+			moved++
+			if to != "d:6379" {
+				t.Fatalf("key %s moved between old nodes %s -> %s", key, from, to)
+			}
+		}
+	}
+	t.Log("moved", moved, "counts", counts)
+	if moved > keys/3 {
+		t.Error("too many keys moved", moved)
+	}
+	for name, n := range counts {
+		if n < keys/8 || n > keys*3/8 {
+			t.Error("uneven distribution", name, n)
+		}
+	}
+
+	weighted := &ShardSystem{Names: names, Weights: []int{1, 1, 2}, Children: make([]CacheSystem, 3)}
+	counts = map[string]int{}
+	for i := 0; i < keys; i++ {
+		counts[weighted.Name(weighted.pickIndex(strconv.Itoa(i)))]++
+	}
+	t.Log("weighted counts", counts)
+	if counts["c:6379"] < counts["a:6379"]*3/2 {
+		t.Error("weight not respected", counts)
+	}
+}
+
+func TestPreviousRing(t *testing.T) {
+	old := &CountingCache{Callback: func(n int, args interface{}) (string, error) { return "old", nil }}
+	missing := &CountingCache{Callback: func(n int, args interface{}) (string, error) { return "", fmt.Errorf("missing") }}
+
+	prev := &ShardSystem{Names: []string{"a"}, Children: []CacheSystem{old}}
+	sh := &ShardSystem{Names: []string{"b"}, Children: []CacheSystem{missing}, Previous: prev, PreviousUntil: time.Now().Add(time.Minute)}
+	if val, err := sh.Load("123"); err != nil || val != "old" {
+		t.Error("previous ring not consulted", val, err)
+	}
+
+	sh = &ShardSystem{Names: []string{"b"}, Children: []CacheSystem{missing}, Previous: prev, PreviousUntil: time.Now().Add(-time.Minute)}
+	if _, err := sh.Load("123"); err == nil {
+		t.Error("previous ring consulted after the transition")
+	}
+}
+
+type mapCache struct {
+	vals  map[string]string
+	err   error
+	calls int
+	mu    sync.Mutex
+}
+
+func (m *mapCache) Store(k, v string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	if m.err != nil {
+		return m.err
+	}
+	m.vals[k] = v
+	return nil
+}
+
+func (m *mapCache) Load(k string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	if m.err != nil {
+		return "", m.err
+	}
+	if v, found := m.vals[k]; found {
+		return v, nil
+	}
+	return "", RecallMissingErr
+}
+
+func (m *mapCache) String() string { return fmt.Sprintf(`map cache %d`, len(m.vals)) }
+
+func TestReplicatedQuorum(t *testing.T) {
+	a, b := &mapCache{vals: map[string]string{}}, &mapCache{vals: map[string]string{}}
+	down := &mapCache{vals: map[string]string{}, err: fmt.Errorf("connection refused")}
+	sh := &ShardSystem{Children: []CacheSystem{a, b, down}, Replicas: 3, WriteQuorum: 2, BreakerThreshold: 2, BreakerCooldown: time.Minute}
+
+	for i := 0; i < 20; i++ {
+		key := strconv.Itoa(i)
+		if err := sh.Store(key, "v"+key, time.Minute); err != nil {
+			t.Fatal("store failed with one node down", err)
+		}
+		if val, err := sh.Load(key); err != nil || val != "v"+key {
+			t.Fatal("load failed with one node down", val, err)
+		}
+	}
+	if down.calls > 2 {
+		t.Error("breaker didn't open, down node called", down.calls, "times")
 	}
 	t.Log(sh)
-	p.Store("h", "a")
-	t.Log(p, sh)
 
-	sh.Pick("9e0mCxci7xnttCYfFkUtHVaExZg=")
-	sh.Pick("hello worlh")
+	strict := &ShardSystem{Children: []CacheSystem{a, down}, Replicas: 2, WriteQuorum: 2, BreakerThreshold: 1, BreakerCooldown: time.Minute}
+	if err := strict.Store("x", "y", time.Minute); err == nil {
+		t.Error("quorum of 2 met with 1 healthy write")
+	}
+	// with down's breaker open only one replica is left, which can't make the quorum
+	calls := a.calls
+	if err := strict.Store("x", "y", time.Minute); err != QuorumUnavailableErr || a.calls != calls {
+		t.Error("wrote below the quorum once a breaker opened", err, a.calls-calls)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := &Breaker{Threshold: 2, Cooldown: 20 * time.Millisecond}
+	b.Record(RecallMissingErr)
+	b.Record(fmt.Errorf("a"))
+	if !b.Allow() {
+		t.Error("opened too early")
+	}
+	b.Record(fmt.Errorf("b"))
+	if b.Allow() {
+		t.Error("didn't open")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !b.Allow() {
+		t.Error("no trial after cooldown")
+	}
+	if b.Allow() {
+		t.Error("more than one trial let through")
+	}
+	b.Record(nil)
+	if !b.Allow() {
+		t.Error("didn't close after a success")
+	}
 }
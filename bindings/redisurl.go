@@ -0,0 +1,123 @@
+package bindings
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"gopkg.in/redis.v5"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	RedisSingle   = "single"
+	RedisSentinel = "sentinel"
+	RedisCluster  = "cluster"
+)
+
+// How to reach one entry of the recall url list, parsed from one of
+//
+//	host:port
+//	redis://[:password@]host:port[/db][?tls=true]  (rediss:// implies tls)
+//	sentinel://[:password@]mastername[/db]?addr=host:port&addr=host:port
+//	cluster://[:password@]host:port[?addr=host:port]
+type RedisConfig struct {
+	Mode     string
+	Addrs    []string
+	Master   string
+	Password string
+	DB       int
+	TLS      bool
+}
+
+var TLSUnsupportedErr = errors.New("tls is only supported for single redis nodes")
+
+func ParseRedisURL(s string) (*RedisConfig, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "://") {
+		return &RedisConfig{Mode: RedisSingle, Addrs: []string{s}}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &RedisConfig{}
+	if u.User != nil {
+		c.Password, _ = u.User.Password()
+	}
+	q := u.Query()
+	c.TLS = u.Scheme == "rediss" || q.Get("tls") == "true"
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.DB, err = strconv.Atoi(db); err != nil {
+			// the url without its password, c isn't filled in enough to print yet
+			redacted := *u
+			redacted.User = nil
+			return nil, fmt.Errorf(`invalid redis db %q in %s`, db, redacted.String())
+		}
+	}
+
+	switch u.Scheme {
+	case "redis", "rediss":
+		c.Mode = RedisSingle
+		c.Addrs = []string{u.Host}
+	case "sentinel":
+		c.Mode = RedisSentinel
+		c.Master = u.Host
+		c.Addrs = q["addr"]
+		if len(c.Addrs) == 0 {
+			return nil, fmt.Errorf(`sentinel %s needs at least one addr`, c.Master)
+		}
+	case "cluster":
+		c.Mode = RedisCluster
+		c.Addrs = append([]string{u.Host}, q["addr"]...)
+		if c.DB != 0 {
+			return nil, errors.New("redis cluster only has db 0")
+		}
+	default:
+		return nil, fmt.Errorf(`unknown redis scheme %s`, u.Scheme)
+	}
+	if c.TLS && c.Mode != RedisSingle {
+		return nil, TLSUnsupportedErr
+	}
+	return c, nil
+}
+
+func (c *RedisConfig) Client() redis.Cmdable {
+	switch c.Mode {
+	case RedisSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{MasterName: c.Master, SentinelAddrs: c.Addrs, Password: c.Password, DB: c.DB})
+	case RedisCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{Addrs: c.Addrs, Password: c.Password})
+	default:
+		opts := &redis.Options{Addr: c.Addrs[0], Password: c.Password, DB: c.DB}
+		if c.TLS {
+			host := c.Addrs[0]
+			if i := strings.LastIndex(host, ":"); i >= 0 {
+				host = host[:i]
+			}
+			opts.TLSConfig = &tls.Config{ServerName: host}
+		}
+		return redis.NewClient(opts)
+	}
+}
+
+// Identifies the node without its password, used as the shard name so it must stay stable
+func (c *RedisConfig) String() string {
+	switch c.Mode {
+	case RedisSentinel:
+		return fmt.Sprintf(`sentinel:%s/%d`, c.Master, c.DB)
+	case RedisCluster:
+		return `cluster:` + strings.Join(c.Addrs, `,`)
+	default:
+		addr := ""
+		if len(c.Addrs) > 0 {
+			addr = c.Addrs[0]
+		}
+		if c.DB != 0 {
+			return fmt.Sprintf(`%s/%d`, addr, c.DB)
+		}
+		return addr
+	}
+}
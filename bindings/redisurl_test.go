@@ -0,0 +1,58 @@
+package bindings
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRedisURL(t *testing.T) {
+	for url, want := range map[string]RedisConfig{
+		"localhost:6379":                                       {Mode: RedisSingle, Addrs: []string{"localhost:6379"}},
+		"redis://:pw@10.0.0.1:6379/2":                          {Mode: RedisSingle, Addrs: []string{"10.0.0.1:6379"}, Password: "pw", DB: 2},
+		"rediss://cache.internal:6380":                         {Mode: RedisSingle, Addrs: []string{"cache.internal:6380"}, TLS: true},
+		"redis://h:6379?tls=true":                              {Mode: RedisSingle, Addrs: []string{"h:6379"}, TLS: true},
+		"sentinel://:pw@recalls/1?addr=s1:26379&addr=s2:26379": {Mode: RedisSentinel, Master: "recalls", Addrs: []string{"s1:26379", "s2:26379"}, Password: "pw", DB: 1},
+		"cluster://c1:7000?addr=c2:7001":                       {Mode: RedisCluster, Addrs: []string{"c1:7000", "c2:7001"}},
+	} {
+		got, err := ParseRedisURL(url)
+		if err != nil {
+			t.Error(url, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("%s parsed as %#v", url, *got)
+		}
+	}
+
+	for _, url := range []string{
+		"sentinel://recalls",
+		"cluster://c1:7000/3",
+		"cluster://c1:7000?tls=true",
+		"sentinel://recalls?addr=s1:26379&tls=true",
+		"memcache://m1:11211",
+		"redis://h:6379/x",
+	} {
+		if _, err := ParseRedisURL(url); err == nil {
+			t.Error("expected an error for", url)
+		}
+	}
+}
+
+func TestRedisConfigName(t *testing.T) {
+	c, _ := ParseRedisURL("redis://:secret@h:6379/2")
+	if c.String() != "h:6379/2" {
+		t.Error("bad name", c.String())
+	}
+	c, _ = ParseRedisURL("h:6379")
+	if c.String() != "h:6379" {
+		t.Error("plain urls should keep their old shard name", c.String())
+	}
+	if (&RedisConfig{}).String() != "" {
+		t.Error("empty config should have an empty name")
+	}
+
+	_, err := ParseRedisURL("redis://:secret@h:6379/x")
+	if err == nil || err.Error() != `invalid redis db "x" in redis://h:6379/x` {
+		t.Error("bad db error should show the url without its password", err)
+	}
+}
@@ -0,0 +1,136 @@
+package bindings
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Hours before the current one that are summed again on every run, catching wins saved after their hour was rolled up
+const DefaultRollupTrailing = 3 * time.Hour
+
+// Keeps purchases_hourly, the purchases summed per hour, billable, ssp, folder, creative and dimension.
+// Each run replaces the trailing hours and anything not rolled up yet in one transaction, so running it again
+// (or on several instances at once) never counts a win twice. Raw purchases older than Retention are deleted
+// once rolled up, 0 keeps them forever. The cpa report joins raw purchases, so it only reaches back that far.
+type Rollups struct {
+	Env       BindingDeps
+	Trailing  time.Duration
+	Retention time.Duration
+}
+
+// Rolls the hours up to and including the one now is in, reports the range it covered
+func (s Rollups) Aggregate(now time.Time) (from, to time.Time, err error) {
+	trailing := s.Trailing
+	if trailing <= 0 {
+		trailing = DefaultRollupTrailing
+	}
+	to = now.Truncate(time.Hour).Add(time.Hour)
+	from = to.Add(-time.Hour - trailing)
+
+	tx, err := s.Env.StatsDB.Begin()
+	if err != nil {
+		s.Env.Debug.Println("err", err)
+		return from, to, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// another instance is already on it
+	var locked bool
+	if err = tx.QueryRow(sqlLockRollups).Scan(&locked); err != nil {
+		s.Env.Debug.Println("err", err)
+		return from, to, err
+	}
+	if !locked {
+		s.Env.Debug.Println("rollups locked elsewhere, skipping")
+		return from, to, tx.Rollback()
+	}
+
+	// catch up from wherever the last run got to
+	var last *time.Time
+	if err = tx.QueryRow(sqlLastRollup).Scan(&last); err != nil {
+		s.Env.Debug.Println("err", err)
+		return from, to, err
+	}
+	if last == nil {
+		// first run, roll up everything there is
+		from = time.Time{}
+	} else if last.Before(from) {
+		from = *last
+	}
+
+	if _, err = tx.Exec(sqlClearRollups, from, to); err != nil {
+		s.Env.Debug.Println("err", err)
+		return from, to, err
+	}
+	if _, err = tx.Exec(sqlInsertRollups, from, to); err != nil {
+		s.Env.Debug.Println("err", err)
+		return from, to, err
+	}
+	if s.Retention > 0 {
+		// never drop rows newer than what was just rolled up
+		cutoff := now.Add(-s.Retention).Truncate(time.Hour)
+		if cutoff.After(from) {
+			cutoff = from
+		}
+		var res sql.Result
+		if res, err = tx.Exec(sqlExpirePurchases, cutoff); err != nil {
+			s.Env.Debug.Println("err", err)
+			return from, to, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			s.Env.Logger.Println("expired purchases before", cutoff, n)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		s.Env.Debug.Println("err", err)
+		return from, to, err
+	}
+	s.Env.Logger.Println("rolled up purchases", from, to)
+	return from, to, nil
+}
+
+// The lock id is arbitrary, it just has to be the same on every instance
+const sqlLockRollups = `SELECT pg_try_advisory_xact_lock(7411)`
+
+const sqlLastRollup = `SELECT MAX(hour) FROM purchases_hourly`
+
+const sqlClearRollups = `DELETE FROM purchases_hourly WHERE hour >= $1 AND hour < $2`
+
+const sqlInsertRollups = `INSERT INTO purchases_hourly (hour, billable, ssp_id, folder_id, creative_id, country_id, vertical_id, brand_id, network_id, subnetwork_id, networktype_id, gender_id, devicetype_id, wins, rev_tx, rev_tx_home, rev_ssp, rev_ssp_home)
+	SELECT date_trunc('hour', created_at), billable, ssp_id, folder_id, creative_id, country_id, vertical_id, brand_id, network_id, subnetwork_id, networktype_id, gender_id, devicetype_id, COUNT(*), SUM(rev_tx), SUM(rev_tx_home), SUM(rev_ssp), SUM(rev_ssp_home)
+	FROM purchases
+	WHERE created_at >= $1 AND created_at < $2
+	GROUP BY 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13
+`
+
+const sqlExpirePurchases = `DELETE FROM purchases WHERE created_at < $1`
+
+const sqlCreateRollups = `CREATE TABLE purchases_hourly (
+	hour timestamp NOT NULL,
+	billable bool NOT NULL,
+	ssp_id int NOT NULL,
+
+	folder_id int NOT NULL,
+	creative_id int NOT NULL,
+
+	country_id int NOT NULL,
+	vertical_id int NOT NULL,
+	brand_id int NOT NULL,
+	network_id int NOT NULL,
+	subnetwork_id int NOT NULL,
+	networktype_id int NOT NULL,
+	gender_id int NOT NULL,
+	devicetype_id int NOT NULL,
+
+	wins int NOT NULL,
+	rev_tx bigint NOT NULL,
+	rev_tx_home bigint NOT NULL,
+	rev_ssp bigint NOT NULL,
+	rev_ssp_home bigint NOT NULL
+);`
+
+const sqlIndexRollups = `CREATE INDEX purchases_hourly_hour ON purchases_hourly (hour)`
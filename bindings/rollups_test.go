@@ -0,0 +1,53 @@
+package bindings
+
+import (
+	"github.com/DATA-DOG/go-sqlmock"
+	"testing"
+	"time"
+)
+
+func TestRollups(t *testing.T) {
+	db, sqlm, _ := sqlmock.New()
+	l, fin := BufferedLogger(t)
+	defer fin()
+	r := Rollups{Env: BindingDeps{StatsDB: db, Logger: l, Debug: l}, Retention: 48 * time.Hour}
+	now := time.Date(2017, 3, 10, 12, 30, 0, 0, time.UTC)
+	to := time.Date(2017, 3, 10, 13, 0, 0, 0, time.UTC)
+
+	// last run was this morning, so the trailing three hours are covered anyway
+	sqlm.ExpectBegin()
+	sqlm.ExpectQuery("pg_try_advisory_xact_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	sqlm.ExpectQuery("SELECT MAX").WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(time.Date(2017, 3, 10, 11, 0, 0, 0, time.UTC)))
+	sqlm.ExpectExec("DELETE FROM purchases_hourly").WithArgs(to.Add(-4*time.Hour), to).WillReturnResult(sqlmock.NewResult(0, 10))
+	sqlm.ExpectExec("INSERT INTO purchases_hourly").WithArgs(to.Add(-4*time.Hour), to).WillReturnResult(sqlmock.NewResult(0, 12))
+	sqlm.ExpectExec("DELETE FROM purchases WHERE").WithArgs(time.Date(2017, 3, 8, 12, 0, 0, 0, time.UTC)).WillReturnResult(sqlmock.NewResult(0, 100))
+	sqlm.ExpectCommit()
+	if _, _, err := r.Aggregate(now); err != nil {
+		t.Error(err)
+	}
+
+	// the job was down for days, it catches up and keeps the raw rows it hasn't rolled up
+	lastRun := time.Date(2017, 3, 5, 0, 0, 0, 0, time.UTC)
+	sqlm.ExpectBegin()
+	sqlm.ExpectQuery("pg_try_advisory_xact_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	sqlm.ExpectQuery("SELECT MAX").WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(lastRun))
+	sqlm.ExpectExec("DELETE FROM purchases_hourly").WithArgs(lastRun, to).WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlm.ExpectExec("INSERT INTO purchases_hourly").WithArgs(lastRun, to).WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlm.ExpectExec("DELETE FROM purchases WHERE").WithArgs(lastRun).WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlm.ExpectCommit()
+	if from, _, err := r.Aggregate(now); err != nil || !from.Equal(lastRun) {
+		t.Error("didn't catch up", from, err)
+	}
+
+	// someone else holds the lock
+	sqlm.ExpectBegin()
+	sqlm.ExpectQuery("pg_try_advisory_xact_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+	sqlm.ExpectRollback()
+	if _, _, err := r.Aggregate(now); err != nil {
+		t.Error(err)
+	}
+
+	if err := sqlm.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,68 @@
+package bindings
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Snowflake ids are milliseconds since SnowflakeEpoch, then the instance, then a per millisecond sequence.
+// Unique as long as no two running instances share an instance id, so no retries are needed.
+const (
+	snowflakeInstanceBits = 10
+	snowflakeSequenceBits = 12
+	MaxSnowflakeInstance  = 1<<snowflakeInstanceBits - 1
+	maxSnowflakeSequence  = 1<<snowflakeSequenceBits - 1
+)
+
+var SnowflakeEpoch = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var InvalidInstanceErr = errors.New("snowflake instance out of range")
+
+type Snowflake struct {
+	Instance int
+
+	mu   sync.Mutex
+	last int64
+	seq  int64
+}
+
+func NewSnowflake(instance int) (*Snowflake, error) {
+	if instance < 0 || instance > MaxSnowflakeInstance {
+		return nil, InvalidInstanceErr
+	}
+	return &Snowflake{Instance: instance}, nil
+}
+
+// For when no instance id is configured, collisions are then only unlikely rather than impossible
+func RandomSnowflake() *Snowflake {
+	b := make([]byte, 2)
+	rand.Read(b)
+	return &Snowflake{Instance: int(binary.BigEndian.Uint16(b)) & MaxSnowflakeInstance}
+}
+
+func (s *Snowflake) Next() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := int64(time.Since(SnowflakeEpoch) / time.Millisecond)
+	if now < s.last {
+		// the clock went backwards, keep counting on from the last id rather than reuse one
+		now = s.last
+	}
+	if now == s.last {
+		s.seq++
+		if s.seq > maxSnowflakeSequence {
+			for now <= s.last {
+				time.Sleep(100 * time.Microsecond)
+				now = int64(time.Since(SnowflakeEpoch) / time.Millisecond)
+			}
+			s.seq = 0
+		}
+	} else {
+		s.seq = 0
+	}
+	s.last = now
+	return now<<(snowflakeInstanceBits+snowflakeSequenceBits) | int64(s.Instance)<<snowflakeSequenceBits | s.seq
+}
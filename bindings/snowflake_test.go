@@ -0,0 +1,56 @@
+package bindings
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSnowflakeUnique(t *testing.T) {
+	a, _ := NewSnowflake(1)
+	b, _ := NewSnowflake(2)
+	mu := sync.Mutex{}
+	seen := map[int64]bool{}
+	wg := sync.WaitGroup{}
+	for _, s := range []*Snowflake{a, a, b, b} {
+		wg.Add(1)
+		go func(s *Snowflake) {
+			defer wg.Done()
+			ids := make([]int64, 10000)
+			for n := range ids {
+				ids[n] = s.Next()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, id := range ids {
+				if id <= 0 || seen[id] {
+					t.Error("bad or repeated id", id)
+					return
+				}
+				seen[id] = true
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	if id := b.Next(); int(id>>snowflakeSequenceBits)&MaxSnowflakeInstance != 2 {
+		t.Error("instance not encoded", id)
+	}
+	if _, err := NewSnowflake(MaxSnowflakeInstance + 1); err != InvalidInstanceErr {
+		t.Error("expected an out of range instance", err)
+	}
+}
+
+func TestSnowflakeSpread(t *testing.T) {
+	s := &Snowflake{}
+	sh := &ShardSystem{Children: []CacheSystem{&CountingCache{}, &CountingCache{}, &CountingCache{}}}
+	counts := make([]int, 3)
+	for i := 0; i < 3000; i++ {
+		counts[sh.pickIndex(strconv.FormatInt(s.Next(), 10))]++
+	}
+	for n, c := range counts {
+		if c < 700 {
+			t.Error("sequential ids skewed away from shard", n, counts)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package bindings
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"math/rand"
+)
+
+// Bid requests dropped by the switches, in total and per ssp and folder, served on /debug/vars
+var ThrottleMetrics = expvar.NewMap("throttle")
+
+// Operator controls over bidding, read as JSON from the ms/switches config key, eg
+//
+//	{"global": 100, "ssp": {"7": 0}, "folder": {"12": 50}}
+//
+// Each is the percentage of traffic still bid on, so 0 is a kill switch. Anything unset is 100.
+type Switches struct {
+	Global int         `json:"global"`
+	SSP    map[int]int `json:"ssp"`
+	Folder map[int]int `json:"folder"`
+}
+
+var InvalidShareErr = errors.New("switch percentages must be between 0 and 100")
+
+func ParseSwitches(s string) (*Switches, error) {
+	sw := &Switches{Global: 100}
+	if s == "" {
+		return sw, nil
+	}
+	if err := json.Unmarshal([]byte(s), sw); err != nil {
+		return nil, err
+	}
+	shares := []int{sw.Global}
+	for _, pct := range sw.SSP {
+		shares = append(shares, pct)
+	}
+	for _, pct := range sw.Folder {
+		shares = append(shares, pct)
+	}
+	for _, pct := range shares {
+		if pct < 0 || pct > 100 {
+			return nil, InvalidShareErr
+		}
+	}
+	return sw, nil
+}
+
+// Percentage of the ssp's traffic to bid on, after the global switch
+func (s *Switches) SSPShare(ssp int) int {
+	if s == nil {
+		return 100
+	}
+	pct := s.Global
+	if sspPct, found := s.SSP[ssp]; found {
+		pct = pct * sspPct / 100
+	}
+	return pct
+}
+
+func (s *Switches) FolderShare(folder int) int {
+	if s == nil {
+		return 100
+	}
+	if pct, found := s.Folder[folder]; found {
+		return pct
+	}
+	return 100
+}
+
+// Whether a request falls within share percent
+func Roll(share int) bool {
+	if share >= 100 {
+		return true
+	}
+	return rand.Intn(100) < share
+}
@@ -0,0 +1,33 @@
+package bindings
+
+import (
+	"testing"
+)
+
+func TestSwitches(t *testing.T) {
+	var unset *Switches
+	if unset.SSPShare(1) != 100 || unset.FolderShare(1) != 100 {
+		t.Error("no switches should bid on everything")
+	}
+
+	sw, err := ParseSwitches(`{"global": 50, "ssp": {"7": 0, "8": 50}, "folder": {"12": 25}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sw.SSPShare(1) != 50 || sw.SSPShare(7) != 0 || sw.SSPShare(8) != 25 || sw.FolderShare(12) != 25 || sw.FolderShare(13) != 100 {
+		t.Error("wrong shares", sw)
+	}
+	if sw, _ := ParseSwitches(`{"ssp": {"7": 0}}`); sw.SSPShare(1) != 100 {
+		t.Error("global should default to 100")
+	}
+
+	for _, bad := range []string{`{"global": 101}`, `{"ssp": {"7": -1}}`, `{"folder": {"x": 1}}`, `{`} {
+		if _, err := ParseSwitches(bad); err == nil {
+			t.Error("expected an error for", bad)
+		}
+	}
+
+	if Roll(0) || !Roll(100) {
+		t.Error("roll ignores the extremes")
+	}
+}
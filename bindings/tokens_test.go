@@ -0,0 +1,37 @@
+package bindings
+
+import (
+	"testing"
+)
+
+func TestTokenCodec(t *testing.T) {
+	legacy := &B64{Key: []byte("hello"), IV: []byte("whatwhat")}
+	c := NewTokenCodec(legacy)
+
+	tok, err := c.Seal([]byte("1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("sealed", tok)
+	if again, _ := c.Seal([]byte("1234")); again == tok {
+		t.Error("nonce not random")
+	}
+	if pt, err := c.Open(tok); err != nil || string(pt) != "1234" {
+		t.Error("couldn't open sealed token", string(pt), err)
+	}
+
+	tampered := tok[:len(tok)-2] + "AA"
+	if _, err := c.Open(tampered); err == nil {
+		t.Error("tampered token opened")
+	}
+
+	old, _ := legacy.Encrypt([]byte("1234"))
+	if pt, err := c.Open(old); err != nil || string(pt) != "1234" {
+		t.Error("couldn't open legacy token", string(pt), err)
+	}
+
+	other := NewTokenCodec(&B64{Key: []byte("goodbye"), IV: []byte("whatwhat")})
+	if _, err := other.Open(tok); err == nil {
+		t.Error("token opened with the wrong key")
+	}
+}
@@ -1,11 +1,15 @@
 package dsp_flights
 
 import (
+	"encoding"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/clixxa/dsp/bindings"
 	"github.com/clixxa/dsp/rtb_types"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"runtime/debug"
 	"strconv"
@@ -21,6 +25,10 @@ type BidEntrypoint struct {
 	BindingDeps bindings.BindingDeps
 	Logic       BiddingLogic
 	AllTest     bool
+	// callers allowed a trace, see WantsTrace
+	DebugNets []*net.IPNet
+	// read storage from this snapshot file instead of ConfigDB, and leave StatsDB alone
+	Snapshot string
 }
 
 func (e *BidEntrypoint) Cycle() error {
@@ -33,34 +41,31 @@ func (e *BidEntrypoint) Cycle() error {
 		df.Runtime.Logger = e.BindingDeps.Logger
 		df.Runtime.Logger.Println("brand new runtime")
 		df.Runtime.Debug = e.BindingDeps.Debug
-		df.Runtime.Storage.Recalls = bindings.Recalls{Env: e.BindingDeps}.Save
-		s := strings.Split(e.BindingDeps.DefaultKey, ":")
-		key, iv := s[0], s[1]
-		df.Runtime.DefaultB64 = &bindings.B64{Key: []byte(key), IV: []byte(iv)}
 		df.Runtime.Logic = e.Logic
 		df.Runtime.TestOnly = e.AllTest
 
-		if err := (bindings.StatsDB{}).Marshal(e.BindingDeps.StatsDB); err != nil {
+		if e.Snapshot != "" {
+			e.BindingDeps.Logger.Println("bidding from snapshot", e.Snapshot)
+		} else if err := (bindings.StatsDB{}).Marshal(e.BindingDeps.StatsDB); err != nil {
 			e.BindingDeps.Debug.Println("err:", err.Error())
 			return err
 		}
 	}
 
-	if err := df.Runtime.Storage.Folders.Unmarshal(1, e.BindingDeps); err != nil {
-		e.BindingDeps.Debug.Println("err:", err.Error())
-		return err
-	}
-	if err := df.Runtime.Storage.Creatives.Unmarshal(1, e.BindingDeps); err != nil {
-		e.BindingDeps.Debug.Println("err:", err.Error())
-		return err
-	}
+	// keys, the redis ring and recall ttls can change between cycles
+	df.Runtime.DefaultTokens = e.BindingDeps.DefaultTokens
+	df.Runtime.Storage.Recalls = bindings.Recalls{Env: e.BindingDeps}.Save
+	df.Runtime.Switches = e.BindingDeps.Switches
+	df.Runtime.Audit = e.BindingDeps.Audit
+	df.Runtime.AuditSampling = e.BindingDeps.AuditSampling
+	df.Runtime.DebugNets = e.DebugNets
 
-	if err := df.Runtime.Storage.Users.Unmarshal(1, e.BindingDeps); err != nil {
-		e.BindingDeps.Debug.Println("err:", err.Error())
-		return err
-	}
-	if err := df.Runtime.Storage.Pseudonyms.Unmarshal(1, e.BindingDeps); err != nil {
-		e.BindingDeps.Debug.Println("err:", err.Error())
+	if e.Snapshot != "" {
+		if err := df.Runtime.Storage.LoadSnapshot(e.Snapshot); err != nil {
+			e.BindingDeps.Debug.Println("err:", err.Error())
+			return err
+		}
+	} else if err := df.Runtime.Storage.Load(e.BindingDeps); err != nil {
 		return err
 	}
 
@@ -100,25 +105,54 @@ func (s SimpleLogic) SelectFolderAndCreative(flight *DemandFlight, folders []Ele
 	flight.Runtime.Logger.Println(`folders`, strings.Join(foldIds, ","), `to choose from, picked`, eg.FolderID)
 	flight.FolderID = eg.FolderID
 	flight.FullPrice = eg.BidAmount
-	folder := flight.Runtime.Storage.Folders.ByID(eg.FolderID)
-	flight.CreativeID = folder.Creative[flight.Request.RawRequest.Random255%len(folder.Creative)]
+	flight.CreativeID = eg.Creatives[flight.Request.RawRequest.Random255%len(eg.Creatives)]
 }
 
 func (s SimpleLogic) CalculateRevshare(flight *DemandFlight) float64 { return 98.0 }
 
-func (s SimpleLogic) GenerateClickID(*DemandFlight) string { return "" }
+// Encodes the recall, folder and creative into a {ct} token sealed with the folder owner's key
+func (s SimpleLogic) GenerateClickID(flight *DemandFlight) string {
+	tok := bindings.ClickToken{RecallID: flight.RecallID, FolderID: flight.FolderID, CreativeID: flight.CreativeID, Time: time.Now()}
+	ct, err := tok.Encode(flight.OwnerTokens())
+	if err != nil {
+		flight.Runtime.Logger.Println(`failed to encode click token`, err.Error())
+	}
+	return ct
+}
+
+// Bids with the highest paying folder instead of a random one, otherwise the same as SimpleLogic
+type HighestLogic struct {
+	SimpleLogic
+}
+
+func (h HighestLogic) SelectFolderAndCreative(flight *DemandFlight, folders []ElegibleFolder, totalCpc int) {
+	eg := folders[0]
+	for _, folder := range folders[1:] {
+		if folder.BidAmount > eg.BidAmount {
+			eg = folder
+		}
+	}
+	flight.Runtime.Logger.Println(`highest paying folder`, eg.FolderID, `of`, len(folders))
+	flight.FolderID = eg.FolderID
+	flight.FullPrice = eg.BidAmount
+	flight.CreativeID = eg.Creatives[flight.Request.RawRequest.Random255%len(eg.Creatives)]
+}
+
+// The logics that can be picked by name, eg by the replay command
+var Logics = map[string]BiddingLogic{
+	"simple":  SimpleLogic{},
+	"highest": HighestLogic{},
+}
 
 type DemandFlight struct {
 	Runtime struct {
-		DefaultB64 *bindings.B64
-		Storage    struct {
-			Folders    bindings.Folders
-			Creatives  bindings.Creatives
-			Pseudonyms bindings.Pseudonyms
-			Users      bindings.Users
+		DefaultTokens *bindings.TokenCodec
+		Switches      *bindings.Switches
+		Audit         *bindings.AuditLog
+		AuditSampling *bindings.AuditSampling
+		DebugNets     []*net.IPNet
+		Storage       Storage
 
-			Recalls func(json.Marshaler, *error, *int)
-		}
 		Logger   *log.Logger
 		Debug    *log.Logger
 		TestOnly bool
@@ -132,14 +166,64 @@ type DemandFlight struct {
 	CreativeID int     `json:"creative"`
 	Request    Request `json:"req"`
 	Margin     int     `json:"margin"`
+	SspID      int     `json:"ssp"`
 	StartTime  time.Time
 
 	RecallID  int    `json:"-"`
 	FullPrice int    `json:"-"`
 	WinUrl    string `json:"-"`
+	Throttled bool   `json:"-"`
+
+	// the impression being bid on, and the creatives already bid with for the earlier ones
+	ImpIndex      int          `json:"-"`
+	UsedCreatives map[int]bool `json:"-"`
+	// impressions whose bid failed, by index, the others' bids still go out
+	ImpErrors map[int]error `json:"-"`
+
+	// kept for the audit log, rejections are only collected when there is one and are by impression then folder
+	RawBody      []byte                 `json:"-"`
+	Rejections   map[int]map[int]string `json:"-"`
+	Status       int                    `json:"-"`
+	ResponseBody []byte                 `json:"-"`
+	// only set when the caller asked for one, see WantsTrace
+	Trace *Trace `json:"-"`
 
 	Response rtb_types.Response `json:"-"`
 	Error    error              `json:"-"`
+	// why the request was refused with a 400, see ValidateBidRequest
+	Invalid error `json:"-"`
+}
+
+// Everything a flight reads from ConfigDB, plus where recalls are saved
+type Storage struct {
+	Folders    bindings.Folders
+	Creatives  bindings.Creatives
+	Pseudonyms bindings.Pseudonyms
+	Users      bindings.Users
+
+	Recalls func(encoding.BinaryMarshaler, int, *error, *int)
+}
+
+// Reads the folders, creatives, users and pseudonyms from ConfigDB, Recalls is left alone
+func (s *Storage) Load(env bindings.BindingDeps) error {
+	if err := s.Folders.Unmarshal(1, env); err != nil {
+		env.Debug.Println("err:", err.Error())
+		return err
+	}
+	if err := s.Creatives.Unmarshal(1, env); err != nil {
+		env.Debug.Println("err:", err.Error())
+		return err
+	}
+
+	if err := s.Users.Unmarshal(1, env); err != nil {
+		env.Debug.Println("err:", err.Error())
+		return err
+	}
+	if err := s.Pseudonyms.Unmarshal(1, env); err != nil {
+		env.Debug.Println("err:", err.Error())
+		return err
+	}
+	return nil
 }
 
 type dfProxy DemandFlight
@@ -156,6 +240,16 @@ func (df *DemandFlight) String() string {
 	return fmt.Sprintf(`demandflight e%s`, e)
 }
 
+// The keys of the selected folder's owner, or the default keys if there aren't any
+func (df *DemandFlight) OwnerTokens() *bindings.TokenCodec {
+	if folder := df.Runtime.Storage.Folders.ByID(df.FolderID); folder != nil {
+		if user := df.Runtime.Storage.Users.ByID(folder.OwnerID); user != nil && user.Tokens != nil {
+			return user.Tokens
+		}
+	}
+	return df.Runtime.DefaultTokens
+}
+
 func (df *DemandFlight) Launch() {
 	defer func() {
 		if err := recover(); err != nil {
@@ -165,21 +259,44 @@ func (df *DemandFlight) Launch() {
 		}
 	}()
 	ReadBidRequest(df)
-	FindClient(df)
-	PrepareResponse(df)
+	ValidateBidRequest(df)
+	CheckThrottle(df)
+	BidImpressions(df)
 	WriteBidResponse(df)
+	AuditBid(df)
 }
 
+// Bid requests are a few kilobytes, anything past this is refused rather than read into memory
+const MaxBidRequestBytes = 1 << 20
+
+var BidRequestTooLargeErr = errors.New("request body too large")
+
 func ReadBidRequest(flight *DemandFlight) {
 	flight.Runtime.Logger.Println(`starting ReadBidRequest!`)
 	flight.StartTime = time.Now()
 
-	if e := json.NewDecoder(flight.HttpRequest.Body).Decode(&flight.Request.RawRequest); e != nil {
+	body, e := ioutil.ReadAll(http.MaxBytesReader(flight.HttpResponse, flight.HttpRequest.Body, MaxBidRequestBytes))
+	flight.RawBody = body
+	if e != nil && int64(len(body)) >= MaxBidRequestBytes {
+		flight.Invalid = BidRequestTooLargeErr
+		flight.Runtime.Logger.Println(`body over`, MaxBidRequestBytes, `bytes`)
+	} else if e != nil {
 		flight.Error = e
+		flight.Runtime.Logger.Println(`failed to read body`, e.Error())
+	} else if e := json.Unmarshal(body, &flight.Request.RawRequest); e != nil {
+		// the ssp's fault rather than ours, so it's a 400
+		flight.Invalid = e
 		flight.Runtime.Logger.Println(`failed to decode body`, e.Error())
 	}
 
-	flight.WinUrl = `http://` + flight.HttpRequest.Host + `/win?price=${AUCTION_PRICE}&key=${AUCTION_BID_ID}&imp=${AUCTION_IMP_ID}`
+	// ssps post to /{sspid}, the win url carries it too in case the recall has expired by the time the win arrives
+	if id, e := strconv.Atoi(strings.Trim(flight.HttpRequest.URL.Path, `/`)); e == nil {
+		flight.SspID = id
+	}
+	if WantsTrace(flight.HttpRequest, flight.Runtime.DebugNets) {
+		flight.Trace = &Trace{}
+	}
+	flight.WinUrl = `http://` + flight.HttpRequest.Host + `/win?price=${AUCTION_PRICE}&key=${AUCTION_BID_ID}&imp=${AUCTION_IMP_ID}&ssp=` + strconv.Itoa(flight.SspID)
 
 	if dim, found := flight.Runtime.Storage.Pseudonyms.Subnetworks[flight.Request.RawRequest.Site.SubNetwork]; !found {
 		flight.Runtime.Logger.Printf(`dim not found %s`, flight.Request.RawRequest.Site.SubNetwork)
@@ -230,15 +347,95 @@ func ReadBidRequest(flight *DemandFlight) {
 	}
 
 	flight.Runtime.Logger.Println("dimensions decoded:", flight.Request)
+	if flight.Trace != nil {
+		flight.Trace.Dimensions = flight.Request.Dimensions()
+	}
+}
+
+// Drops the request if the global or ssp switch says so, before any folders are looked at
+func CheckThrottle(flight *DemandFlight) {
+	if flight.Error != nil || flight.Invalid != nil {
+		return
+	}
+	if share := flight.Runtime.Switches.SSPShare(flight.SspID); !bindings.Roll(share) {
+		flight.Throttled = true
+		if flight.Trace != nil {
+			flight.Trace.Throttled = true
+		}
+		bindings.ThrottleMetrics.Add("requests", 1)
+		bindings.ThrottleMetrics.Add(`ssp_`+strconv.Itoa(flight.SspID), 1)
+		flight.Runtime.Logger.Printf(`ssp %d throttled to %d%%, not bidding`, flight.SspID, share)
+	}
+}
+
+// The impression being bid on, nil if the request has none
+func (flight *DemandFlight) Impression() *rtb_types.Impression {
+	if imps := flight.Request.RawRequest.Impressions; flight.ImpIndex < len(imps) {
+		return &imps[flight.ImpIndex]
+	}
+	return nil
+}
+
+// Bids on each impression in turn, each with its own floor and recall and never with a creative already used.
+// An impression failing only loses its own bid, the request fails when there's nothing else to send.
+func BidImpressions(flight *DemandFlight) {
+	if flight.Error != nil {
+		return
+	}
+	var first error
+	for n := range flight.Request.RawRequest.Impressions {
+		flight.ImpIndex = n
+		flight.FolderID, flight.CreativeID, flight.FullPrice, flight.Margin, flight.RecallID = 0, 0, 0, 0, 0
+		FindClient(flight)
+		PrepareResponse(flight)
+		if flight.Error == nil {
+			continue
+		}
+		flight.Runtime.Logger.Println(`impression`, n, `failed, dropping its bid:`, flight.Error.Error())
+		if sel := flight.selection(); sel != nil {
+			sel.Error = flight.Error.Error()
+		}
+		if flight.ImpErrors == nil {
+			flight.ImpErrors = map[int]error{}
+			first = flight.Error
+		}
+		flight.ImpErrors[n], flight.Error = flight.Error, nil
+	}
+	if first != nil && len(flight.Response.SeatBids) == 0 {
+		flight.Error = first
+	}
+}
+
+// The folder's creatives that can be bid with, loaded with a url that parses and not used on an earlier impression.
+// Creatives skipped at load time for a bad url leave their folder out of selection instead of losing the bid.
+func (flight *DemandFlight) usableCreatives(folder *bindings.Folder) []int {
+	usable := []int{}
+	for _, id := range folder.Creative {
+		if flight.UsedCreatives[id] {
+			continue
+		}
+		cr := flight.Runtime.Storage.Creatives.ByID(id)
+		if cr == nil {
+			continue
+		}
+		if cr.Template == nil {
+			if _, err := bindings.ParseURLTemplate(cr.RedirectUrl); err != nil {
+				continue
+			}
+		}
+		usable = append(usable, id)
+	}
+	return usable
 }
 
 // Fill out the elegible bid
 func FindClient(flight *DemandFlight) {
 	flight.Runtime.Logger.Println(`starting FindClient`, flight.String())
-	if flight.Error != nil {
+	if flight.Error != nil || flight.Invalid != nil || flight.Throttled {
 		return
 	}
 
+	imp := flight.Impression()
 	FolderMatches := func(folder *bindings.Folder) string {
 		if !folder.Active {
 			return "Inactive"
@@ -319,7 +516,7 @@ func FindClient(flight *DemandFlight) {
 			return "Vertical"
 		}
 	CheckBidfloor:
-		if folder.CPC > 0 && folder.CPC < flight.Request.RawRequest.Impressions[0].BidFloor {
+		if imp != nil && folder.CPC > 0 && folder.CPC < imp.BidFloor {
 			return "CPC"
 		}
 		return ""
@@ -331,18 +528,28 @@ func FindClient(flight *DemandFlight) {
 	Visit := func(folder *bindings.Folder) bool {
 		if s := FolderMatches(folder); s != "" {
 			flight.Runtime.Logger.Printf("folder %d doesn't match cause %s..", folder.ID, s)
+			flight.reject(folder, s)
+			return false
+		}
+		// a throttled folder takes its children with it
+		if share := flight.Runtime.Switches.FolderShare(folder.ID); !bindings.Roll(share) {
+			flight.Runtime.Logger.Printf("folder %d throttled to %d%%..", folder.ID, share)
+			flight.reject(folder, "Throttled")
+			bindings.ThrottleMetrics.Add(`folder_`+strconv.Itoa(folder.ID), 1)
 			return false
 		}
 
 		flight.Runtime.Logger.Printf("folder %d matches..", folder.ID)
 
-		if len(folder.Creative) > 0 {
-			cpc := folder.CPC
-			if folder.ParentID != nil && cpc == 0 {
-				cpc = flight.Runtime.Storage.Folders.ByID(*folder.ParentID).CPC
-			}
+		cpc, inherited := folder.CPC, false
+		if folder.ParentID != nil && cpc == 0 {
+			cpc, inherited = flight.Runtime.Storage.Folders.ByID(*folder.ParentID).CPC, true
+		}
+		creatives := flight.usableCreatives(folder)
+		flight.matched(folder, cpc, inherited, len(creatives) > 0)
+		if len(creatives) > 0 {
 			totalCpc += cpc
-			folders = append(folders, ElegibleFolder{FolderID: folder.ID, BidAmount: cpc})
+			folders = append(folders, ElegibleFolder{FolderID: folder.ID, BidAmount: cpc, Creatives: creatives})
 		}
 
 		return true
@@ -361,12 +568,17 @@ func FindClient(flight *DemandFlight) {
 		}
 	}
 
+	flight.traceUnvisited()
+
 	if len(folders) == 0 {
 		flight.Runtime.Logger.Println(`no folder found`)
 		return
 	}
 
 	flight.Runtime.Logic.SelectFolderAndCreative(flight, folders, totalCpc)
+	if flight.Trace != nil && flight.FolderID != 0 {
+		flight.Trace.Selected = append(flight.Trace.Selected, &Selection{Imp: flight.ImpIndex, FolderID: flight.FolderID, CreativeID: flight.CreativeID, FullPrice: flight.FullPrice})
+	}
 }
 
 func PrepareResponse(flight *DemandFlight) {
@@ -382,71 +594,100 @@ func PrepareResponse(flight *DemandFlight) {
 	flight.Runtime.Logger.Printf("rev calculated at %f", revShare)
 	bid.Price = fp * revShare / 100
 	flight.Margin = flight.FullPrice - int(bid.Price)
-
-	net, found := flight.Runtime.Storage.Pseudonyms.NetworkIDS[flight.Request.NetworkID]
-	if !found {
-		flight.Runtime.Logger.Printf(`net not found %d`, flight.Request.NetworkID)
-		net = ""
-	}
-	snet, found := flight.Runtime.Storage.Pseudonyms.SubnetworkIDS[flight.Request.SubNetworkID]
-	if !found {
-		flight.Runtime.Logger.Printf(`snet not found %d`, flight.Request.SubNetworkID)
-		snet = ""
+	if sel := flight.selection(); sel != nil {
+		sel.Price = bid.Price
 	}
-	brand, found := flight.Runtime.Storage.Pseudonyms.BrandIDS[flight.Request.BrandID]
-	if !found {
-		flight.Runtime.Logger.Printf(`brand not found %d`, flight.Request.BrandID)
-		brand = ""
-	}
-	brandSlug, found := flight.Runtime.Storage.Pseudonyms.BrandSlugIDS[flight.Request.BrandID]
-	if !found {
-		flight.Runtime.Logger.Printf(`brandSlug not found %d`, flight.Request.BrandID)
-		brandSlug = ""
+
+	cr := flight.Runtime.Storage.Creatives.ByID(flight.CreativeID)
+	if cr == nil {
+		flight.Runtime.Logger.Printf(`creative %d not loaded, not bidding`, flight.CreativeID)
+		return
 	}
-	vert, found := flight.Runtime.Storage.Pseudonyms.VerticalIDS[flight.Request.VerticalID]
-	if !found {
-		flight.Runtime.Logger.Printf(`vert not found %d`, flight.Request.VerticalID)
-		vert = ""
+	tmpl := cr.Template
+	if tmpl == nil {
+		t, err := bindings.ParseURLTemplate(cr.RedirectUrl)
+		if err != nil {
+			flight.Runtime.Logger.Printf(`creative %d url invalid, not bidding: %s`, cr.ID, err.Error())
+			return
+		}
+		tmpl = t
 	}
 
-	ct := flight.Runtime.Logic.GenerateClickID(flight)
-
 	flight.Runtime.Logger.Println(`saving reference to KVS`)
 
-	flight.Runtime.Storage.Recalls(flight, &flight.Error, &flight.RecallID)
+	flight.Runtime.Storage.Recalls(flight, flight.SspID, &flight.Error, &flight.RecallID)
 	bid.ID = strconv.Itoa(flight.RecallID)
 
-	bid.WinUrl = flight.WinUrl
-
-	clickid := flight.Runtime.DefaultB64.Encrypt([]byte(fmt.Sprintf(`%d`, flight.RecallID)))
-
-	cr := flight.Runtime.Storage.Creatives.ByID(flight.CreativeID)
-	url := cr.RedirectUrl
-	url = strings.Replace(url, `{realnetwork}`, "", 1)
-	url = strings.Replace(url, `{realsubnetwork}`, "", 1)
-	url = strings.Replace(url, `{ct}`, ct, 1)
-	url = strings.Replace(url, `{clickid}`, fmt.Sprintf(`%s`, clickid), 1)
+	ct := flight.Runtime.Logic.GenerateClickID(flight)
 
-	url = strings.Replace(url, `{network}`, fmt.Sprintf(`%s`, net), 1)
-	url = strings.Replace(url, `{subnetwork}`, fmt.Sprintf(`%s`, snet), 1)
-	url = strings.Replace(url, `{brand}`, fmt.Sprintf(`%s`, brand), 1)
-	url = strings.Replace(url, `{brandurl}`, fmt.Sprintf(`%s`, brandSlug), 1)
-	url = strings.Replace(url, `{vertical}`, fmt.Sprintf(`%s`, vert), 1)
+	bid.WinUrl = flight.WinUrl
+	if imp := flight.Impression(); imp != nil {
+		bid.ImpID = imp.ID
+	}
 
-	url = strings.Replace(url, `{cpc}`, fmt.Sprintf(`%f`, fp/100000), 1)
-	url = strings.Replace(url, `{placement}`, flight.Request.RawRequest.Site.Placement, 1)
+	clickid, err := flight.OwnerTokens().Seal([]byte(strconv.Itoa(flight.RecallID)))
+	if err != nil && flight.Error == nil {
+		flight.Error = err
+	}
 
-	bid.URL = url
+	macros := flight.MacroValues()
+	macros[`{ct}`] = ct
+	macros[`{clickid}`] = clickid
+	macros[`{cpc}`] = fmt.Sprintf(`%f`, fp/100000)
+	macros[`{price}`] = fmt.Sprintf(`%f`, bid.Price/100000)
+	macros[`${AUCTION_BID_ID}`] = bid.ID
+	bid.URL = tmpl.Expand(macros)
 
 	if flight.Error != nil {
 		flight.Runtime.Logger.Println(`error occured in FindClient: %s`, flight.Error.Error())
 		return
 	}
 
-	flight.Response.SeatBids = append(flight.Response.SeatBids, rtb_types.SeatBid{Bids: []rtb_types.Bid{bid}})
+	// every impression's bid goes in the one seatbid
+	if len(flight.Response.SeatBids) == 0 {
+		flight.Response.SeatBids = []rtb_types.SeatBid{{}}
+	}
+	flight.Response.SeatBids[0].Bids = append(flight.Response.SeatBids[0].Bids, bid)
+	if flight.UsedCreatives == nil {
+		flight.UsedCreatives = map[int]bool{}
+	}
+	flight.UsedCreatives[flight.CreativeID] = true
 	flight.Runtime.Logger.Println("finished FindClient", flight.String())
 }
 
+// The request's dimensions resolved back to names, keyed by macro
+func (flight *DemandFlight) MacroValues() map[string]string {
+	p := &flight.Runtime.Storage.Pseudonyms
+	raw := &flight.Request.RawRequest
+	values := map[string]string{
+		`{placement}`: raw.Site.Placement,
+		`{guid}`:      raw.User.PubGuid,
+	}
+	lookup := func(macro string, names map[int]string, id int) {
+		if name, found := names[id]; found {
+			values[macro] = name
+		} else {
+			flight.Runtime.Logger.Printf(`%s not found %d`, macro, id)
+		}
+	}
+	lookup(`{network}`, p.NetworkIDS, flight.Request.NetworkID)
+	lookup(`{subnetwork}`, p.SubnetworkIDS, flight.Request.SubNetworkID)
+	lookup(`{realsubnetwork}`, p.SubnetworkLabelIDS, flight.Request.SubNetworkID)
+	lookup(`{realnetwork}`, p.NetworkIDS, p.SubnetworkToNetwork[flight.Request.SubNetworkID])
+	lookup(`{brand}`, p.BrandIDS, flight.Request.BrandID)
+	lookup(`{brandurl}`, p.BrandSlugIDS, flight.Request.BrandID)
+	lookup(`{vertical}`, p.VerticalIDS, flight.Request.VerticalID)
+	lookup(`{country}`, p.CountryIDS, flight.Request.CountryID)
+	lookup(`{devicetype}`, p.DeviceTypeIDs, flight.Request.DeviceTypeID)
+	lookup(`{gender}`, p.GenderIDs, flight.Request.GenderID)
+
+	if imp := flight.Impression(); imp != nil && imp.ID != "" {
+		values[`{impid}`] = imp.ID
+		values[`${AUCTION_IMP_ID}`] = imp.ID
+	}
+	return values
+}
+
 func WriteBidResponse(flight *DemandFlight) {
 	var res []byte
 	if flight.Runtime.TestOnly && len(flight.Response.SeatBids) > 0 && !flight.Request.RawRequest.Test {
@@ -454,7 +695,19 @@ func WriteBidResponse(flight *DemandFlight) {
 		flight.Response.SeatBids = nil
 	}
 
-	if len(flight.Response.SeatBids) > 0 {
+	if flight.Invalid != nil {
+		flight.Response.NoBidReason, flight.Response.Error = rtb_types.NoBidInvalidRequest, flight.Invalid.Error()
+	}
+
+	// a trace goes out even without a bid
+	if flight.Trace != nil {
+		if flight.Error != nil {
+			flight.Trace.Error = flight.Error.Error()
+		}
+		flight.Response.Debug = flight.Trace
+	}
+
+	if len(flight.Response.SeatBids) > 0 || flight.Trace != nil || flight.Invalid != nil {
 		if j, e := json.Marshal(flight.Response); e != nil && flight.Error == nil {
 			flight.Error = e
 			flight.Runtime.Logger.Println(`error encoding`, e.Error())
@@ -463,11 +716,25 @@ func WriteBidResponse(flight *DemandFlight) {
 		}
 	}
 
-	if flight.Error != nil {
+	if flight.Error != nil && (flight.Trace == nil || res == nil) {
 		flight.Runtime.Logger.Printf("err during request %s, returning 500", flight.Error.Error())
+		flight.Status = http.StatusInternalServerError
 		flight.HttpResponse.WriteHeader(http.StatusInternalServerError)
+	} else if flight.Invalid != nil {
+		flight.Runtime.Logger.Printf("invalid request %s, returning 400", flight.Invalid.Error())
+		flight.Status, flight.ResponseBody = http.StatusBadRequest, res
+		flight.HttpResponse.Header().Set(`Content-Type`, `application/json`)
+		flight.HttpResponse.WriteHeader(http.StatusBadRequest)
+		flight.HttpResponse.Write(res)
+	} else if flight.Error != nil {
+		flight.Runtime.Logger.Printf("err during traced request %s, returning 500 with the trace", flight.Error.Error())
+		flight.Status, flight.ResponseBody = http.StatusInternalServerError, res
+		flight.HttpResponse.Header().Set(`Content-Type`, `application/json`)
+		flight.HttpResponse.WriteHeader(http.StatusInternalServerError)
+		flight.HttpResponse.Write(res)
 	} else if res != nil {
 		flight.Runtime.Logger.Printf(`looks good and has a response, returning code %d`, http.StatusOK)
+		flight.Status, flight.ResponseBody = http.StatusOK, res
 		flight.HttpResponse.Header().Set(`Content-Length`, strconv.Itoa(len(res)))
 		flight.HttpResponse.WriteHeader(http.StatusOK)
 		if n, e := flight.HttpResponse.Write(res); e != nil {
@@ -475,11 +742,50 @@ func WriteBidResponse(flight *DemandFlight) {
 		}
 	} else {
 		flight.Runtime.Logger.Printf(`looks good but no response, returning code %d`, http.StatusNoContent)
+		flight.Status = http.StatusNoContent
 		flight.HttpResponse.WriteHeader(http.StatusNoContent)
 	}
 	flight.Runtime.Logger.Println(`dsp /bid took`, time.Since(flight.StartTime))
 }
 
+// Queues the request and what we made of it for the audit log if it's sampled, the writing happens elsewhere
+func AuditBid(flight *DemandFlight) {
+	if flight.Runtime.Audit == nil || !flight.Runtime.AuditSampling.Sample(flight.SspID, flight.Error != nil || flight.Invalid != nil || len(flight.ImpErrors) > 0) {
+		return
+	}
+	entry := &bindings.AuditEntry{
+		Time:       flight.StartTime,
+		ID:         flight.Request.RawRequest.ID,
+		SspID:      flight.SspID,
+		Body:       string(flight.RawBody),
+		Dimensions: flight.Request.Dimensions(),
+		Rejections: flight.Rejections,
+		Status:     flight.Status,
+		Response:   string(flight.ResponseBody),
+	}
+	for _, sb := range flight.Response.SeatBids {
+		for _, bid := range sb.Bids {
+			entry.BidIDs = append(entry.BidIDs, bid.ID)
+		}
+	}
+	if flight.Error != nil {
+		entry.Error = flight.Error.Error()
+	} else if flight.Invalid != nil {
+		entry.Error = flight.Invalid.Error()
+	} else if len(flight.ImpErrors) > 0 {
+		errs := []string{}
+		for n := range flight.Request.RawRequest.Impressions {
+			if err, found := flight.ImpErrors[n]; found {
+				errs = append(errs, fmt.Sprintf(`imp %d: %s`, n, err.Error()))
+			}
+		}
+		entry.Error = strings.Join(errs, `; `)
+	}
+	if !flight.Runtime.Audit.Enqueue(entry) {
+		flight.Runtime.Logger.Println(`audit queue full, entry dropped`)
+	}
+}
+
 type Request struct {
 	RawRequest rtb_types.Request
 
@@ -493,7 +799,23 @@ type Request struct {
 	GenderID      int
 }
 
+// The resolved dimension ids, without the raw request
+func (r Request) Dimensions() map[string]int {
+	return map[string]int{
+		"vertical":    r.VerticalID,
+		"brand":       r.BrandID,
+		"network":     r.NetworkID,
+		"subnetwork":  r.SubNetworkID,
+		"networktype": r.NetworkTypeID,
+		"devicetype":  r.DeviceTypeID,
+		"country":     r.CountryID,
+		"gender":      r.GenderID,
+	}
+}
+
+// Creatives are the folder's usable ones, see usableCreatives
 type ElegibleFolder struct {
 	FolderID  int
 	BidAmount int
+	Creatives []int
 }
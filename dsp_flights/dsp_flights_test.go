@@ -1,12 +1,25 @@
 package dsp_flights
 
 import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/clixxa/dsp/bindings"
 	"github.com/clixxa/dsp/rtb_types"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestStageFindClient(t *testing.T) {
@@ -14,10 +27,10 @@ func TestStageFindClient(t *testing.T) {
 	flight := &DemandFlight{}
 	flight.Runtime.Logger = l
 	flight.Runtime.Logger.Println("testing StoreFlight, before:", flight)
-	flight.Runtime.DefaultB64 = &bindings.B64{Key: []byte("gekk"), IV: []byte("whatwhat")}
+	flight.Runtime.DefaultTokens = bindings.NewTokenCodec(&bindings.B64{Key: []byte("gekk"), IV: []byte("whatwhat")})
 
 	store := &flight.Runtime.Storage
-	store.Recalls = func(df json.Marshaler, a *error, b *int) {
+	store.Recalls = func(df encoding.BinaryMarshaler, ssp int, a *error, b *int) {
 		t.Log("recall save", df)
 	}
 	flight.Runtime.Logic = SimpleLogic{}
@@ -67,7 +80,8 @@ func TestWhitelist(t *testing.T) {
 	flight := &DemandFlight{}
 	flight.Runtime.Logic = SimpleLogic{}
 	flight.Runtime.Logger = l
-	f := flight.Runtime.Storage.Folders.ByID(flight.Runtime.Storage.Folders.Add(&bindings.Folder{Active: true, Creative: []int{3}, Network: []int{1, 2}}))
+	cr := flight.Runtime.Storage.Creatives.Add(&bindings.Creative{})
+	f := flight.Runtime.Storage.Folders.ByID(flight.Runtime.Storage.Folders.Add(&bindings.Folder{Active: true, Creative: []int{cr}, Network: []int{1, 2}}))
 	flight.Request.NetworkID = 2
 	FindClient(flight)
 	if flight.FolderID != f.ID {
@@ -121,7 +135,7 @@ func TestLoadAll(t *testing.T) {
 	sqlm.MatchExpectationsInOrder(false)
 
 	out, dump := bindings.BufferedLogger(t)
-	be := &BidEntrypoint{BindingDeps: bindings.BindingDeps{ConfigDB: db, StatsDB: db, Logger: out, Debug: out, DefaultKey: ":", Redis: &bindings.RandomCache{&bindings.CountingCache{}}}}
+	be := &BidEntrypoint{BindingDeps: bindings.BindingDeps{ConfigDB: db, StatsDB: db, Logger: out, Debug: out, DefaultKey: ":", Redis: &bindings.RandomCache{CacheSystem: &bindings.CountingCache{}}}}
 	if err := be.Cycle(); err != nil {
 		t.Log("failed to cycle, dumping")
 		dump()
@@ -136,3 +150,563 @@ func TestLoadAll(t *testing.T) {
 		t.Error("err", err.Error())
 	}
 }
+
+func TestPrepareResponseMacros(t *testing.T) {
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+	flight := &DemandFlight{}
+	flight.Runtime.Logger = l
+	flight.Runtime.Logic = SimpleLogic{}
+	flight.Runtime.DefaultTokens = bindings.NewTokenCodec(&bindings.B64{Key: []byte("gekk"), IV: []byte("whatwhat")})
+	store := &flight.Runtime.Storage
+	store.Recalls = func(df encoding.BinaryMarshaler, ssp int, a *error, b *int) { *b = 77 }
+	store.Pseudonyms.BrandIDS = map[int]string{6: "big brand"}
+	store.Pseudonyms.CountryIDS = map[int]string{3: "CA"}
+
+	flight.CreativeID = store.Creatives.Add(&bindings.Creative{RedirectUrl: `http://x.com/?b={brand}&c={country}&b2={brand}&id=${AUCTION_BID_ID}&p=${AUCTION_PRICE}&imp={impid}`})
+	flight.FolderID = store.Folders.Add(&bindings.Folder{Creative: []int{flight.CreativeID}, CPC: 500})
+	flight.FullPrice = 500
+	flight.Request.BrandID = 6
+	flight.Request.CountryID = 3
+	flight.Request.RawRequest.Impressions = []rtb_types.Impression{{ID: "i1"}}
+
+	PrepareResponse(flight)
+	if len(flight.Response.SeatBids) != 1 {
+		t.Fatal("no bid made", flight.Error)
+	}
+	want := `http://x.com/?b=big+brand&c=CA&b2=big+brand&id=77&p=${AUCTION_PRICE}&imp=i1`
+	if got := flight.Response.SeatBids[0].Bids[0].URL; got != want {
+		t.Errorf("got url %s, wanted %s", got, want)
+	}
+}
+
+func TestRecallEncoding(t *testing.T) {
+	flight := &DemandFlight{FolderID: 12, CreativeID: 400, Margin: -30, SspID: 9}
+	flight.Request = Request{VerticalID: 1, BrandID: 2, NetworkID: 3, SubNetworkID: 4, NetworkTypeID: 5, DeviceTypeID: 6, CountryID: 7, GenderID: 8}
+	flight.Request.RawRequest.Test = true
+	flight.Request.RawRequest.Impressions = []rtb_types.Impression{{}}
+
+	b, _ := flight.MarshalBinary()
+	js, _ := flight.MarshalJSON()
+	if len(b) > 20 || len(b) >= len(js) {
+		t.Errorf("binary recall is %d bytes, json %d", len(b), len(js))
+	}
+
+	for name, d := range map[string][]byte{"binary": b, "json": js, "trailing": append(b, 0x02, 0x04)} {
+		got := &DemandFlight{}
+		if err := got.UnmarshalBinary(d); err != nil {
+			t.Error(name, err)
+			continue
+		}
+		if got.FolderID != 12 || got.SspID != 9 || got.CreativeID != 400 || got.Margin != -30 || !got.Request.RawRequest.Test || got.Request.GenderID != 8 || got.Request.VerticalID != 1 {
+			t.Errorf("%s recall decoded wrong %#v", name, got.Request)
+		}
+	}
+
+	// instances still running the old decoder read the first fields and ignore the ssp after them
+	old := &DemandFlight{}
+	d := b[1:]
+	for _, f := range old.recallFields(new(int))[:recallRequiredFields] {
+		v, n := binary.Varint(d)
+		if n <= 0 {
+			t.Fatal("recall unreadable by the old field list")
+		}
+		*f, d = int(v), d[n:]
+	}
+	if b[0] != recallV1 || old.FolderID != 12 || old.Request.GenderID != 8 {
+		t.Error("old decoder read the recall wrong", b[0], old.FolderID, old.Request.GenderID)
+	}
+	noSsp := &DemandFlight{}
+	if err := noSsp.UnmarshalBinary(b[:len(b)-1]); err != nil || noSsp.SspID != 0 || noSsp.Request.GenderID != 8 {
+		t.Error("recall from before the ssp was appended decoded wrong", err)
+	}
+
+	if err := (&DemandFlight{}).UnmarshalBinary(b[:5]); err != TruncatedRecallErr {
+		t.Error("expected a truncated recall", err)
+	}
+	if err := (&DemandFlight{}).UnmarshalBinary([]byte{9, 1}); err != UnknownRecallErr {
+		t.Error("expected an unknown version", err)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+	flight := &DemandFlight{}
+	flight.Runtime.Logic = SimpleLogic{}
+	flight.Runtime.Logger = l
+	store := &flight.Runtime.Storage
+	cr := store.Creatives.Add(&bindings.Creative{})
+	killed := store.Folders.Add(&bindings.Folder{Active: true, Creative: []int{cr}})
+	child := store.Folders.Add(&bindings.Folder{Active: true, Creative: []int{cr}})
+	store.Folders.ByID(killed).Children = []int{child}
+	store.Folders.ByID(child).ParentID = &killed
+	open := store.Folders.Add(&bindings.Folder{Active: true, Creative: []int{cr}})
+
+	flight.Runtime.Switches, _ = bindings.ParseSwitches(`{"ssp": {"7": 0}, "folder": {"` + strconv.Itoa(killed) + `": 0}}`)
+	for i := 0; i < 20; i++ {
+		flight.FolderID = 0
+		flight.Request.RawRequest.Random255 = i
+		CheckThrottle(flight)
+		FindClient(flight)
+		if flight.FolderID != open {
+			t.Fatal("throttled folder or its child picked", flight.FolderID)
+		}
+	}
+
+	flight.SspID = 7
+	flight.FolderID = 0
+	CheckThrottle(flight)
+	FindClient(flight)
+	if !flight.Throttled || flight.FolderID != 0 {
+		t.Error("killed ssp still bid")
+	}
+}
+
+func TestAuditBid(t *testing.T) {
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	flight := &DemandFlight{}
+	flight.Runtime.Logger = l
+	flight.Runtime.Logic = SimpleLogic{}
+	flight.Runtime.DefaultTokens = bindings.NewTokenCodec(&bindings.B64{Key: []byte("gekk"), IV: []byte("whatwhat")})
+	flight.Runtime.Audit = &bindings.AuditLog{Dir: dir}
+	flight.Runtime.AuditSampling, _ = bindings.ParseAuditSampling(`{"ssp": {"7": 1}}`)
+	store := &flight.Runtime.Storage
+	store.Recalls = func(df encoding.BinaryMarshaler, ssp int, a *error, b *int) { *b = 77 }
+	store.Pseudonyms.Countries = map[string]int{"CA": 3}
+	cr := store.Creatives.Add(&bindings.Creative{RedirectUrl: `http://x.com/`})
+	store.Folders.Add(&bindings.Folder{Active: true, Creative: []int{cr}, CPC: 500, Country: []int{3}})
+	wrongCountry := store.Folders.Add(&bindings.Folder{Active: true, Creative: []int{cr}, CPC: 500, Country: []int{4}})
+
+	flight.HttpRequest = httptest.NewRequest("POST", "/7", strings.NewReader(`{"id": "req1", "imp": [{"id": "i1"}], "device": {"geo": {"country": "CA"}}}`))
+	flight.HttpResponse = httptest.NewRecorder()
+	flight.Launch()
+	flight.Runtime.Audit.Close()
+
+	out := &bytes.Buffer{}
+	if n, err := bindings.SearchAudit("77", []string{dir}, out); err != nil || n != 1 {
+		t.Fatal("entry not written", n, err)
+	}
+	entry := &bindings.AuditEntry{}
+	if err := json.Unmarshal(out.Bytes(), entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.ID != "req1" || entry.SspID != 7 || entry.Status != 200 || entry.Rejections[0][wrongCountry] != "Country" || !strings.Contains(entry.Body, `"country": "CA"`) || !strings.Contains(entry.Response, `"id":"77"`) {
+		t.Error("wrong entry", out.String())
+	}
+}
+
+func TestBidRequestTooLarge(t *testing.T) {
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+	flight := &DemandFlight{}
+	flight.Runtime.Logger = l
+	body := `{"imp": [{"id": "` + strings.Repeat("x", MaxBidRequestBytes) + `"}]}`
+	flight.HttpRequest = httptest.NewRequest("POST", "/7", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	flight.HttpResponse = rec
+	flight.Launch()
+	if rec.Code != 400 || flight.Invalid != BidRequestTooLargeErr || len(flight.RawBody) > MaxBidRequestBytes {
+		t.Error("oversized body not refused", rec.Code, flight.Invalid, len(flight.RawBody))
+	}
+}
+
+func TestTrace(t *testing.T) {
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+	flight := &DemandFlight{}
+	flight.Runtime.Logger = l
+	flight.Runtime.Logic = SimpleLogic{}
+	flight.Runtime.DefaultTokens = bindings.NewTokenCodec(&bindings.B64{Key: []byte("gekk"), IV: []byte("whatwhat")})
+	flight.Runtime.DebugNets, _ = ParseDebugNets("")
+	store := &flight.Runtime.Storage
+	store.Recalls = func(df encoding.BinaryMarshaler, ssp int, a *error, b *int) { *b = 77 }
+	store.Pseudonyms.Countries = map[string]int{"CA": 3}
+	cr := store.Creatives.Add(&bindings.Creative{RedirectUrl: `http://x.com/`})
+	parent := store.Folders.Add(&bindings.Folder{Active: true, CPC: 500, Country: []int{3}})
+	child := store.Folders.Add(&bindings.Folder{Active: true, Creative: []int{cr}, ParentID: &parent})
+	store.Folders.ByID(parent).Children = []int{child}
+	wrong := store.Folders.Add(&bindings.Folder{Active: true, CPC: 500, Country: []int{4}})
+	orphaned := store.Folders.Add(&bindings.Folder{Active: true, Creative: []int{cr}, ParentID: &wrong})
+	store.Folders.ByID(wrong).Children = []int{orphaned}
+
+	req := httptest.NewRequest("POST", "/7?debug=1", strings.NewReader(`{"imp": [{"id": "i1"}], "device": {"geo": {"country": "CA"}}}`))
+	req.RemoteAddr = "127.0.0.1:5000"
+	rec := httptest.NewRecorder()
+	flight.HttpRequest, flight.HttpResponse = req, rec
+	flight.Launch()
+
+	res := struct {
+		Debug Trace `json:"debug"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err, rec.Body.String())
+	}
+	got := map[int]*FolderTrace{}
+	for _, ft := range res.Debug.Folders {
+		got[ft.ID] = ft
+	}
+	if len(got) != 4 || !got[parent].Matched || got[parent].Eligible {
+		t.Error("parent wrong", rec.Body.String())
+	}
+	if ft := got[child]; ft == nil || !ft.Matched || !ft.Inherited || ft.CPC != 500 || !ft.Eligible {
+		t.Error("child should inherit the parent's cpc", rec.Body.String())
+	}
+	if got[wrong].Rejected != "Country" || got[orphaned].Rejected != "Parent" {
+		t.Error("wrong rejections", rec.Body.String())
+	}
+	if s := res.Debug.Selected; len(s) != 1 || s[0].FolderID != child || s[0].Price != 490 || res.Debug.Dimensions["country"] != 3 {
+		t.Error("wrong selection", rec.Body.String())
+	}
+
+	// outsiders just get the bid
+	flight = &DemandFlight{Runtime: flight.Runtime}
+	req = httptest.NewRequest("POST", "/7", strings.NewReader(`{"imp": [{"id": "i1"}], "device": {"geo": {"country": "CA"}}}`))
+	req.Header.Set("X-Debug", "1")
+	rec = httptest.NewRecorder()
+	flight.HttpRequest, flight.HttpResponse = req, rec
+	flight.Launch()
+	if rec.Code != 200 || strings.Contains(rec.Body.String(), "debug") {
+		t.Error("trace given to an outside caller", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMultipleImpressions(t *testing.T) {
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+	flight := &DemandFlight{}
+	flight.Runtime.Logger = l
+	flight.Runtime.Logic = SimpleLogic{}
+	flight.Runtime.DefaultTokens = bindings.NewTokenCodec(&bindings.B64{Key: []byte("gekk"), IV: []byte("whatwhat")})
+	store := &flight.Runtime.Storage
+	recalls := 0
+	store.Recalls = func(df encoding.BinaryMarshaler, ssp int, a *error, b *int) { recalls++; *b = recalls }
+	first := store.Creatives.Add(&bindings.Creative{RedirectUrl: `http://x.com/?imp={impid}`})
+	second := store.Creatives.Add(&bindings.Creative{RedirectUrl: `http://y.com/?imp={impid}`})
+	cheap := store.Folders.Add(&bindings.Folder{Active: true, Creative: []int{first, second}, CPC: 500})
+	dear := store.Folders.Add(&bindings.Folder{Active: true, Creative: []int{first}, CPC: 2000})
+
+	flight.HttpRequest = httptest.NewRequest("POST", "/7", strings.NewReader(`{"imp": [{"id": "a", "bidfloor": 1000}, {"id": "b"}, {"id": "c", "bidfloor": 5000}]}`))
+	rec := httptest.NewRecorder()
+	flight.HttpResponse = rec
+	flight.Launch()
+
+	res := rtb_types.Response{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || len(res.SeatBids) != 1 {
+		t.Fatal("wrong response", err, rec.Body.String())
+	}
+	bids := res.SeatBids[0].Bids
+	if len(bids) != 2 {
+		t.Fatal("expected a bid for a and b only", rec.Body.String())
+	}
+	// a's floor leaves only the dear folder, so b gets the cheap one's other creative
+	if bids[0].ImpID != "a" || bids[0].Price != 1960 || bids[0].URL != `http://x.com/?imp=a` {
+		t.Error("wrong bid for a", bids[0], dear)
+	}
+	if bids[1].ImpID != "b" || bids[1].Price != 490 || bids[1].URL != `http://y.com/?imp=b` || bids[0].ID == bids[1].ID {
+		t.Error("wrong bid for b", bids[1], cheap)
+	}
+}
+
+func TestValidateBidRequest(t *testing.T) {
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+	for body, reason := range map[string]string{
+		`{"imp": [{"id": "i1"}`:                               `unexpected end of JSON input`,
+		`{"device": {}}`:                                      `imp is required`,
+		`{"imp": [{}], "rand": 256}`:                          `rand 256 is outside 0-255`,
+		`{"imp": [{"id": "a"}, {"id": "b", "bidfloor": -1}]}`: `imp 1 bidfloor -1 is negative`,
+		`{"imp": [{"id": "a"}, {"id": "a"}]}`:                 `imp 1 id a is repeated`,
+		`{"imp": [{"id": "a"}, {}]}`:                          `imp 1 needs an id when there are several`,
+	} {
+		flight := &DemandFlight{}
+		flight.Runtime.Logger = l
+		flight.Runtime.Logic = SimpleLogic{}
+		flight.Runtime.Storage.Pseudonyms.DeviceTypes = map[string]int{"mobile": 2}
+		flight.Runtime.Storage.Pseudonyms.Genders = map[string]int{"male": 1}
+		flight.HttpRequest = httptest.NewRequest("POST", "/9", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		flight.HttpResponse = rec
+		before := ""
+		if v := ValidationMetrics.Get("ssp_9"); v != nil {
+			before = v.String()
+		}
+		flight.Launch()
+
+		res := rtb_types.Response{}
+		if rec.Code != 400 || json.Unmarshal(rec.Body.Bytes(), &res) != nil || res.NoBidReason != rtb_types.NoBidInvalidRequest || res.Error != reason {
+			t.Error("wrong response for", body, rec.Code, rec.Body.String())
+		}
+		if after := ValidationMetrics.Get("ssp_9"); after == nil || after.String() == before {
+			t.Error("failure not counted for", body)
+		}
+	}
+
+	flight := &DemandFlight{}
+	flight.Runtime.Storage.Pseudonyms.DeviceTypes = map[string]int{"mobile": 2}
+	flight.Request.RawRequest.Impressions = []rtb_types.Impression{{ID: "a", BidFloor: 10}, {ID: "b"}}
+	flight.Request.RawRequest.Random255 = 255
+	flight.Request.RawRequest.Device.DeviceType = "mobile"
+	ValidateBidRequest(flight)
+	if flight.Invalid != nil {
+		t.Error("valid request refused", flight.Invalid)
+	}
+
+	// a devicetype we have no id for is bid on without one, and counted
+	before := ""
+	if v := ValidationMetrics.Get("unknown_devicetype"); v != nil {
+		before = v.String()
+	}
+	flight = &DemandFlight{}
+	flight.Runtime.Logger = l
+	flight.Runtime.Logic = SimpleLogic{}
+	flight.Runtime.Storage.Pseudonyms.DeviceTypes = map[string]int{"mobile": 2}
+	flight.HttpRequest = httptest.NewRequest("POST", "/9", strings.NewReader(`{"imp": [{}], "device": {"devicetype": "toaster"}}`))
+	rec := httptest.NewRecorder()
+	flight.HttpResponse = rec
+	flight.Launch()
+	if rec.Code != 204 || flight.Invalid != nil || flight.Request.DeviceTypeID != 0 {
+		t.Error("unknown devicetype refused", rec.Code, flight.Invalid)
+	}
+	if after := ValidationMetrics.Get("unknown_devicetype"); after == nil || after.String() == before {
+		t.Error("unknown devicetype not counted")
+	}
+}
+
+func TestImpressionFailure(t *testing.T) {
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+	flight := &DemandFlight{}
+	flight.Runtime.Logger = l
+	flight.Runtime.Logic = SimpleLogic{}
+	flight.Runtime.DefaultTokens = bindings.NewTokenCodec(&bindings.B64{Key: []byte("gekk"), IV: []byte("whatwhat")})
+	// rejections are only kept with an audit log, nothing is sampled so it's never written
+	flight.Runtime.Audit = &bindings.AuditLog{}
+	store := &flight.Runtime.Storage
+	recalls := 0
+	store.Recalls = func(df encoding.BinaryMarshaler, ssp int, a *error, b *int) {
+		if recalls++; recalls == 2 {
+			*a = fmt.Errorf("redis down")
+		}
+		*b = recalls
+	}
+	first := store.Creatives.Add(&bindings.Creative{RedirectUrl: `http://x.com/`})
+	second := store.Creatives.Add(&bindings.Creative{RedirectUrl: `http://y.com/`})
+	cheap := store.Folders.Add(&bindings.Folder{Active: true, Creative: []int{first, second}, CPC: 500})
+	store.Folders.Add(&bindings.Folder{Active: true, Creative: []int{first}, CPC: 2000})
+
+	flight.HttpRequest = httptest.NewRequest("POST", "/7", strings.NewReader(`{"imp": [{"id": "a", "bidfloor": 1000}, {"id": "b"}]}`))
+	rec := httptest.NewRecorder()
+	flight.HttpResponse = rec
+	flight.Launch()
+
+	res := rtb_types.Response{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != 200 || len(res.SeatBids) != 1 || len(res.SeatBids[0].Bids) != 1 || res.SeatBids[0].Bids[0].ImpID != "a" {
+		t.Fatal("a's bid should go out without b's", rec.Code, rec.Body.String())
+	}
+	if flight.Error != nil || flight.ImpErrors[1] == nil {
+		t.Error("b's failure not kept to itself", flight.Error, flight.ImpErrors)
+	}
+	if flight.Rejections[0][cheap] != "CPC" || flight.Rejections[1][cheap] != "" {
+		t.Error("rejections mixed up between impressions", flight.Rejections)
+	}
+
+	// with nothing to send the failure is the request's
+	flight = &DemandFlight{Runtime: flight.Runtime}
+	recalls = 1
+	flight.HttpRequest = httptest.NewRequest("POST", "/7", strings.NewReader(`{"imp": [{"id": "a"}]}`))
+	rec = httptest.NewRecorder()
+	flight.HttpResponse = rec
+	flight.Launch()
+	if rec.Code != 500 || flight.Error == nil {
+		t.Error("only impression failing should fail the request", rec.Code)
+	}
+}
+
+func TestUnusableCreative(t *testing.T) {
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+	flight := &DemandFlight{}
+	flight.Runtime.Logger = l
+	flight.Runtime.Logic = HighestLogic{}
+	flight.Runtime.DefaultTokens = bindings.NewTokenCodec(&bindings.B64{Key: []byte("gekk"), IV: []byte("whatwhat")})
+	store := &flight.Runtime.Storage
+	store.Recalls = func(df encoding.BinaryMarshaler, ssp int, a *error, b *int) { *b = 77 }
+	good := store.Creatives.Add(&bindings.Creative{RedirectUrl: `http://x.com/`})
+	bad := store.Creatives.Add(&bindings.Creative{RedirectUrl: `http://x.com/{nope}`})
+	cheap := store.Folders.Add(&bindings.Folder{Active: true, Creative: []int{good}, CPC: 500})
+	// skipped at load for its url, so it isn't in storage at all
+	store.Folders.Add(&bindings.Folder{Active: true, Creative: []int{good + 100}, CPC: 3000})
+	store.Folders.Add(&bindings.Folder{Active: true, Creative: []int{bad}, CPC: 2000})
+
+	flight.HttpRequest = httptest.NewRequest("POST", "/7", strings.NewReader(`{"imp": [{"id": "a"}]}`))
+	rec := httptest.NewRecorder()
+	flight.HttpResponse = rec
+	flight.Launch()
+
+	res := rtb_types.Response{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != 200 || len(res.SeatBids) != 1 {
+		t.Fatal("no bid with a usable folder left", rec.Code, rec.Body.String())
+	}
+	if flight.FolderID != cheap || res.SeatBids[0].Bids[0].Price != 490 {
+		t.Error("a folder without usable creatives won", flight.FolderID, rec.Body.String())
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+	storage := Storage{}
+	storage.Pseudonyms.Countries = map[string]int{"CA": 3}
+	storage.Pseudonyms.CountryIDS = map[int]string{3: "CA"}
+	cr := storage.Creatives.Add(&bindings.Creative{RedirectUrl: `http://x.com/?c={country}`})
+	storage.Creatives.Add(&bindings.Creative{RedirectUrl: `http://x.com/?c={unknown}`})
+	parent := storage.Folders.Add(&bindings.Folder{Active: true, CPC: 500, Country: []int{3}})
+	child := storage.Folders.Add(&bindings.Folder{Active: true, Creative: []int{cr}, ParentID: &parent, OwnerID: 1})
+	storage.Folders.ByID(parent).Children = []int{child}
+	storage.Users = bindings.Users{{ID: 1, Key: "secret", IPs: []string{"1.2.3.4"}}}
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/snap.json"
+	if err := storage.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(path); strings.Contains(string(b), "secret") {
+		t.Error("snapshot has user keys in it")
+	}
+
+	// bids from the snapshot without any database
+	e := &BidEntrypoint{Logic: SimpleLogic{}, Snapshot: path}
+	e.BindingDeps = bindings.BindingDeps{Logger: l, Debug: l, DefaultTokens: bindings.NewTokenCodec(&bindings.B64{Key: []byte("gekk"), IV: []byte("whatwhat")})}
+	if err := e.Cycle(); err != nil {
+		t.Fatal(err)
+	}
+	flight := e.DemandFlight()
+	if len(flight.Runtime.Storage.Creatives) != 1 || flight.Runtime.Storage.Creatives.ByID(cr).Template == nil {
+		t.Error("creatives not parsed", flight.Runtime.Storage.Creatives)
+	}
+	if f := flight.Runtime.Storage.Folders.ByID(child); f == nil || *f.ParentID != parent || flight.Runtime.Storage.Users.ByID(1).IPs[0] != "1.2.3.4" {
+		t.Error("storage not restored")
+	}
+	flight.Runtime.Storage.Recalls = func(df encoding.BinaryMarshaler, ssp int, a *error, b *int) { *b = 77 }
+	rec := httptest.NewRecorder()
+	flight.HttpRequest, flight.HttpResponse = httptest.NewRequest("POST", "/7", strings.NewReader(`{"imp": [{"id": "i1"}], "device": {"geo": {"country": "CA"}}}`)), rec
+	flight.Launch()
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `c=CA`) {
+		t.Error("didn't bid from the snapshot", rec.Code, rec.Body.String())
+	}
+
+	if err := storage.ReadSnapshot(strings.NewReader(`{"version": 99}`)); err != UnsupportedSnapshotErr {
+		t.Error("newer snapshot accepted", err)
+	}
+}
+
+// Drops the response, httptest.ResponseRecorder would count towards the allocations
+type discardResponse struct {
+	header http.Header
+}
+
+func (d *discardResponse) Header() http.Header {
+	if d.header == nil {
+		d.header = http.Header{}
+	}
+	return d.header
+}
+func (d *discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardResponse) WriteHeader(int)             {}
+
+func benchRuntime(n int) *DemandFlight {
+	template := &DemandFlight{}
+	quiet := log.New(ioutil.Discard, "", 0)
+	template.Runtime.Logger, template.Runtime.Debug = quiet, quiet
+	template.Runtime.Logic = SimpleLogic{}
+	template.Runtime.DefaultTokens = bindings.NewTokenCodec(&bindings.B64{Key: []byte("gekk"), IV: []byte("whatwhat")})
+	template.Runtime.Storage = SyntheticStorage(n, 1)
+	template.Runtime.Storage.Recalls = func(df encoding.BinaryMarshaler, ssp int, a *error, b *int) { *b = 77 }
+	return template
+}
+
+// Reports the p50 and p99 of the timed calls alongside the usual ns/op
+func reportLatencies(b *testing.B, took []time.Duration) {
+	sort.Slice(took, func(i, j int) bool { return took[i] < took[j] })
+	b.ReportMetric(float64(took[(len(took)-1)*50/100]), "p50-ns")
+	b.ReportMetric(float64(took[(len(took)-1)*99/100]), "p99-ns")
+}
+
+func BenchmarkBid(b *testing.B) {
+	for _, n := range []int{10, 1000, 100000} {
+		b.Run(strconv.Itoa(n)+"folders", func(b *testing.B) {
+			template := benchRuntime(n)
+			r := rand.New(rand.NewSource(1))
+			bodies := make([][]byte, 256)
+			for i := range bodies {
+				bodies[i] = SyntheticRequest(r)
+			}
+			took := make([]time.Duration, b.N)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				flight := &DemandFlight{}
+				flight.Runtime = template.Runtime
+				flight.HttpRequest = httptest.NewRequest("POST", "/7", bytes.NewReader(bodies[i%len(bodies)]))
+				flight.HttpResponse = &discardResponse{}
+				start := time.Now()
+				flight.Launch()
+				took[i] = time.Since(start)
+			}
+			b.StopTimer()
+			reportLatencies(b, took)
+		})
+	}
+}
+
+// The stages on their own, each flight is read before the timer starts
+func BenchmarkStages(b *testing.B) {
+	stages := []struct {
+		name  string
+		stage func(*DemandFlight)
+	}{{"ReadBidRequest", ReadBidRequest}, {"FindClient", FindClient}, {"PrepareResponse", PrepareResponse}}
+	for _, n := range []int{10, 1000, 100000} {
+		template := benchRuntime(n)
+		for _, st := range stages {
+			b.Run(st.name+"/"+strconv.Itoa(n)+"folders", func(b *testing.B) {
+				r := rand.New(rand.NewSource(1))
+				flights := make([]*DemandFlight, b.N)
+				for i := range flights {
+					flight := &DemandFlight{}
+					flight.Runtime = template.Runtime
+					flight.HttpRequest = httptest.NewRequest("POST", "/7", bytes.NewReader(SyntheticRequest(r)))
+					flight.HttpResponse = &discardResponse{}
+					if st.name != "ReadBidRequest" {
+						ReadBidRequest(flight)
+					}
+					if st.name == "PrepareResponse" {
+						FindClient(flight)
+					}
+					flights[i] = flight
+				}
+				took := make([]time.Duration, b.N)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i, flight := range flights {
+					start := time.Now()
+					st.stage(flight)
+					took[i] = time.Since(start)
+				}
+				b.StopTimer()
+				reportLatencies(b, took)
+			})
+		}
+	}
+}
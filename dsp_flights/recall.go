@@ -0,0 +1,63 @@
+package dsp_flights
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// Recalls are a version byte followed by varints of only what the win notice needs, instead of the whole
+// request. Decoders ignore trailing fields so later versions can append to the end.
+const recallV1 = 1
+
+var UnknownRecallErr = errors.New("unknown recall version")
+var TruncatedRecallErr = errors.New("recall truncated")
+
+// How many fields every v1 recall has, the ones after were appended later and may be missing
+const recallRequiredFields = 12
+
+func (df *DemandFlight) recallFields(test *int) []*int {
+	r := &df.Request
+	return []*int{&df.FolderID, &df.CreativeID, &df.Margin, test, &r.VerticalID, &r.BrandID, &r.NetworkID, &r.SubNetworkID, &r.NetworkTypeID, &r.DeviceTypeID, &r.CountryID, &r.GenderID, &df.SspID}
+}
+
+func (df *DemandFlight) MarshalBinary() ([]byte, error) {
+	test := 0
+	if df.Request.RawRequest.Test {
+		test = 1
+	}
+	fields := df.recallFields(&test)
+	buf := make([]byte, 1, 1+len(fields)*binary.MaxVarintLen64)
+	buf[0] = recallV1
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for _, f := range fields {
+		n := binary.PutVarint(tmp, int64(*f))
+		buf = append(buf, tmp[:n]...)
+	}
+	return buf, nil
+}
+
+// Reads binary recalls, and JSON ones saved before the binary encoding
+func (df *DemandFlight) UnmarshalBinary(d []byte) error {
+	if len(d) > 0 && d[0] == '{' {
+		return json.Unmarshal(d, (*dfProxy)(df))
+	}
+	if len(d) == 0 || d[0] != recallV1 {
+		return UnknownRecallErr
+	}
+	test := 0
+	d = d[1:]
+	for i, f := range df.recallFields(&test) {
+		if i >= recallRequiredFields && len(d) == 0 {
+			break
+		}
+		v, n := binary.Varint(d)
+		if n <= 0 {
+			return TruncatedRecallErr
+		}
+		*f = int(v)
+		d = d[n:]
+	}
+	df.Request.RawRequest.Test = test == 1
+	return nil
+}
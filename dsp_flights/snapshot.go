@@ -0,0 +1,81 @@
+package dsp_flights
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/clixxa/dsp/bindings"
+	"io"
+	"os"
+	"time"
+)
+
+// Bumped whenever the snapshot layout changes in a way older readers would get wrong
+const SnapshotVersion = 1
+
+var UnsupportedSnapshotErr = errors.New("unsupported snapshot version")
+
+// Storage as written to a snapshot file. Users are written without their keys, so click tokens made from a
+// snapshot are sealed with the default keys.
+type Snapshot struct {
+	Version    int                 `json:"version"`
+	Taken      time.Time           `json:"taken"`
+	Folders    bindings.Folders    `json:"folders"`
+	Creatives  bindings.Creatives  `json:"creatives"`
+	Users      bindings.Users      `json:"users"`
+	Pseudonyms bindings.Pseudonyms `json:"pseudonyms"`
+}
+
+func (s *Storage) WriteSnapshot(w io.Writer) error {
+	snap := &Snapshot{Version: SnapshotVersion, Taken: time.Now().UTC(), Folders: s.Folders, Creatives: s.Creatives, Pseudonyms: s.Pseudonyms}
+	for _, u := range s.Users {
+		snap.Users = append(snap.Users, &bindings.User{ID: u.ID, IPs: u.IPs, Age: u.Age})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(snap)
+}
+
+// Replaces the folders, creatives, users and pseudonyms with the snapshot's, Recalls is left alone.
+// Creatives with urls this build can't expand are dropped, the same as when loading from ConfigDB.
+func (s *Storage) ReadSnapshot(r io.Reader) error {
+	snap := &Snapshot{}
+	if err := json.NewDecoder(r).Decode(snap); err != nil {
+		return err
+	}
+	if snap.Version < 1 || snap.Version > SnapshotVersion {
+		return UnsupportedSnapshotErr
+	}
+	creatives := bindings.Creatives{}
+	for _, cr := range snap.Creatives {
+		tmpl, err := bindings.ParseURLTemplate(cr.RedirectUrl)
+		if err != nil {
+			bindings.CreativeMetrics.Add("invalid_url", 1)
+			continue
+		}
+		cr.Template = tmpl
+		creatives = append(creatives, cr)
+	}
+	s.Folders, s.Creatives, s.Users, s.Pseudonyms = snap.Folders, creatives, snap.Users, snap.Pseudonyms
+	return nil
+}
+
+func (s *Storage) SaveSnapshot(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := s.WriteSnapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *Storage) LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.ReadSnapshot(f)
+}
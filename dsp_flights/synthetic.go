@@ -0,0 +1,78 @@
+package dsp_flights
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/clixxa/dsp/bindings"
+	"github.com/clixxa/dsp/rtb_types"
+	"math/rand"
+	"strconv"
+)
+
+// What synthetic folders target and synthetic requests come from
+var syntheticCountries = []string{"US", "CA", "GB", "AU", "DE", "FR", "BR", "IN", "JP", "MX"}
+var syntheticNetworks = []string{"search", "social", "display", "native", "video"}
+var syntheticDevices = []string{"desktop", "mobile", "tablet"}
+
+// Builds n made up folders for benchmarks and load tests. Most target a country and some a network or device,
+// about a tenth are children of another folder and half of those inherit its cpc.
+func SyntheticStorage(n int, seed int64) Storage {
+	r := rand.New(rand.NewSource(seed))
+	s := Storage{}
+	p := &s.Pseudonyms
+	p.Countries, p.CountryIDS = map[string]int{}, map[int]string{}
+	for i, name := range syntheticCountries {
+		p.Countries[name], p.CountryIDS[i+1] = i+1, name
+	}
+	p.Networks, p.NetworkIDS = map[string]int{}, map[int]string{}
+	for i, name := range syntheticNetworks {
+		p.Networks[name], p.NetworkIDS[i+1] = i+1, name
+	}
+	p.DeviceTypes = map[string]int{"desktop": 1, "mobile": 2, "tablet": 3, "unknown": 4}
+	p.DeviceTypeIDs = map[int]string{1: "desktop", 2: "mobile", 3: "tablet", 4: "unknown"}
+
+	for id := 1; id <= 20; id++ {
+		url := fmt.Sprintf(`http://example.com/c%d?ct={ct}&country={country}&id=${AUCTION_BID_ID}`, id)
+		tmpl, _ := bindings.ParseURLTemplate(url)
+		s.Creatives = append(s.Creatives, &bindings.Creative{ID: id, RedirectUrl: url, Template: tmpl})
+	}
+
+	// built directly, Folders.Add is quadratic
+	s.Folders = make(bindings.Folders, 0, n)
+	roots := []*bindings.Folder{}
+	for id := 1; id <= n; id++ {
+		f := &bindings.Folder{ID: id, Active: r.Intn(20) > 0, CPC: 1 + r.Intn(1000), Creative: []int{1 + r.Intn(20)}}
+		if r.Intn(10) < 8 {
+			f.Country = []int{1 + r.Intn(len(syntheticCountries))}
+		}
+		if r.Intn(10) < 3 {
+			f.Network = []int{1 + r.Intn(len(syntheticNetworks))}
+		}
+		if r.Intn(10) < 2 {
+			f.DeviceType = []int{1 + r.Intn(len(syntheticDevices))}
+		}
+		if len(roots) > 0 && r.Intn(10) == 0 {
+			parent := roots[r.Intn(len(roots))]
+			f.ParentID = &parent.ID
+			parent.Children = append(parent.Children, id)
+			if r.Intn(2) == 0 {
+				f.CPC = 0
+			}
+		} else {
+			roots = append(roots, f)
+		}
+		s.Folders = append(s.Folders, f)
+	}
+	return s
+}
+
+// A bid request over SyntheticStorage's countries, networks and devices
+func SyntheticRequest(r *rand.Rand) []byte {
+	req := rtb_types.Request{ID: strconv.FormatInt(r.Int63(), 36), Random255: r.Intn(256)}
+	req.Impressions = []rtb_types.Impression{{ID: "1", BidFloor: r.Intn(300)}}
+	req.Site.Network = syntheticNetworks[r.Intn(len(syntheticNetworks))]
+	req.Device.DeviceType = syntheticDevices[r.Intn(len(syntheticDevices))]
+	req.Device.Geo.Country = syntheticCountries[r.Intn(len(syntheticCountries))]
+	b, _ := json.Marshal(req)
+	return b
+}
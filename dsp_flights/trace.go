@@ -0,0 +1,139 @@
+package dsp_flights
+
+import (
+	"github.com/clixxa/dsp/bindings"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// What FindClient made of every folder, returned in the response's debug field when asked for
+type Trace struct {
+	Dimensions map[string]int `json:"dimensions"`
+	Throttled  bool           `json:"throttled,omitempty"`
+	Folders    []*FolderTrace `json:"folders"`
+	Selected   []*Selection   `json:"selected,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// Rejected names the check that failed, eg Country, Throttled, or Parent when the parent was rejected.
+// CPC is what the folder bids once inherited from its parent, only folders with usable creatives bid.
+// Imp is the index of the impression, each is traced separately.
+type FolderTrace struct {
+	Imp       int    `json:"imp"`
+	ID        int    `json:"id"`
+	ParentID  *int   `json:"parent,omitempty"`
+	Matched   bool   `json:"matched"`
+	Rejected  string `json:"rejected,omitempty"`
+	CPC       int    `json:"cpc,omitempty"`
+	Inherited bool   `json:"inherited,omitempty"`
+	Eligible  bool   `json:"eligible,omitempty"`
+}
+
+type Selection struct {
+	Imp        int     `json:"imp"`
+	FolderID   int     `json:"folder"`
+	CreativeID int     `json:"creative"`
+	FullPrice  int     `json:"full_price"`
+	Price      float64 `json:"price"`
+	// set when the bid couldn't be made, eg the recall wasn't saved, so the impression went without
+	Error string `json:"error,omitempty"`
+}
+
+// Callers allowed to ask for a trace when TDEBUGNETS isn't set
+var DefaultDebugNets = "127.0.0.0/8,::1/128"
+
+// Parses a comma separated list of CIDRs, empty gives DefaultDebugNets
+func ParseDebugNets(s string) ([]*net.IPNet, error) {
+	if strings.TrimSpace(s) == "" {
+		s = DefaultDebugNets
+	}
+	nets := []*net.IPNet{}
+	for _, cidr := range strings.Split(s, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Traces are asked for with an X-Debug: 1 header or ?debug=1, and only given to callers within nets
+func WantsTrace(r *http.Request, nets []*net.IPNet) bool {
+	if r.Header.Get("X-Debug") != "1" && r.URL.Query().Get("debug") != "1" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Records why a folder was dropped, for the audit log and the trace
+func (flight *DemandFlight) reject(folder *bindings.Folder, reason string) {
+	if flight.Runtime.Audit != nil {
+		if flight.Rejections == nil {
+			flight.Rejections = map[int]map[int]string{}
+		}
+		if flight.Rejections[flight.ImpIndex] == nil {
+			flight.Rejections[flight.ImpIndex] = map[int]string{}
+		}
+		flight.Rejections[flight.ImpIndex][folder.ID] = reason
+	}
+	if flight.Trace != nil {
+		flight.Trace.Folders = append(flight.Trace.Folders, &FolderTrace{Imp: flight.ImpIndex, ID: folder.ID, ParentID: folder.ParentID, Rejected: reason})
+	}
+}
+
+func (flight *DemandFlight) matched(folder *bindings.Folder, cpc int, inherited, eligible bool) {
+	if flight.Trace != nil {
+		flight.Trace.Folders = append(flight.Trace.Folders, &FolderTrace{Imp: flight.ImpIndex, ID: folder.ID, ParentID: folder.ParentID, Matched: true, CPC: cpc, Inherited: inherited, Eligible: eligible})
+	}
+}
+
+// The current impression's selection, if it has one
+func (flight *DemandFlight) selection() *Selection {
+	if flight.Trace == nil || len(flight.Trace.Selected) == 0 {
+		return nil
+	}
+	if sel := flight.Trace.Selected[len(flight.Trace.Selected)-1]; sel.Imp == flight.ImpIndex {
+		return sel
+	}
+	return nil
+}
+
+// Lists the folders FindClient never looked at, those under a rejected parent or nested too deep
+func (flight *DemandFlight) traceUnvisited() {
+	if flight.Trace == nil {
+		return
+	}
+	seen := map[int]*FolderTrace{}
+	for _, ft := range flight.Trace.Folders {
+		if ft.Imp == flight.ImpIndex {
+			seen[ft.ID] = ft
+		}
+	}
+	for _, folder := range flight.Runtime.Storage.Folders {
+		if _, found := seen[folder.ID]; found {
+			continue
+		}
+		reason := "NotVisited"
+		if folder.ParentID != nil {
+			if parent, found := seen[*folder.ParentID]; found && !parent.Matched {
+				reason = "Parent"
+			}
+		}
+		flight.Trace.Folders = append(flight.Trace.Folders, &FolderTrace{Imp: flight.ImpIndex, ID: folder.ID, ParentID: folder.ParentID, Rejected: reason})
+	}
+}
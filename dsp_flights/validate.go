@@ -0,0 +1,69 @@
+package dsp_flights
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/clixxa/dsp/rtb_types"
+	"strconv"
+)
+
+// Bid requests refused as invalid, in total and per ssp, and enum values we have no id for, served on /debug/vars
+var ValidationMetrics = expvar.NewMap("validation")
+
+// Refuses requests that can't be bid on sensibly, the ssp gets a 400 saying why instead of a 500 or a quiet no bid
+func ValidateBidRequest(flight *DemandFlight) {
+	if flight.Error != nil {
+		return
+	}
+	if flight.Invalid == nil {
+		flight.Invalid = validRequest(&flight.Request.RawRequest)
+	}
+	if flight.Invalid == nil {
+		countUnknownEnums(flight)
+	}
+	if flight.Invalid != nil {
+		ValidationMetrics.Add("requests", 1)
+		ValidationMetrics.Add(`ssp_`+strconv.Itoa(flight.SspID), 1)
+		flight.Runtime.Logger.Println(`invalid request`, flight.Invalid.Error())
+		if flight.Trace != nil {
+			flight.Trace.Error = flight.Invalid.Error()
+		}
+	}
+}
+
+// Checks the fields INTEGRATION.txt requires and the ranges
+func validRequest(raw *rtb_types.Request) error {
+	if len(raw.Impressions) == 0 {
+		return fmt.Errorf(`imp is required`)
+	}
+	if raw.Random255 < 0 || raw.Random255 > 255 {
+		return fmt.Errorf(`rand %d is outside 0-255`, raw.Random255)
+	}
+	ids := map[string]bool{}
+	for n, imp := range raw.Impressions {
+		if imp.BidFloor < 0 {
+			return fmt.Errorf(`imp %d bidfloor %d is negative`, n, imp.BidFloor)
+		}
+		// bids are matched back to impressions by id, a lone impression can go without
+		if imp.ID == "" && len(raw.Impressions) > 1 {
+			return fmt.Errorf(`imp %d needs an id when there are several`, n)
+		}
+		if imp.ID != "" && ids[imp.ID] {
+			return fmt.Errorf(`imp %d id %s is repeated`, n, imp.ID)
+		}
+		ids[imp.ID] = true
+	}
+	return nil
+}
+
+// Enum values without a pseudonym are bid on without that dimension, like before, but counted so a new
+// value from an ssp shows up
+func countUnknownEnums(flight *DemandFlight) {
+	p, raw := &flight.Runtime.Storage.Pseudonyms, &flight.Request.RawRequest
+	if _, found := p.DeviceTypes[raw.Device.DeviceType]; raw.Device.DeviceType != "" && !found {
+		ValidationMetrics.Add("unknown_devicetype", 1)
+	}
+	if _, found := p.Genders[raw.User.Gender]; raw.User.Gender != "" && !found {
+		ValidationMetrics.Add("unknown_gender", 1)
+	}
+}
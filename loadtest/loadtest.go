@@ -0,0 +1,185 @@
+package loadtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/clixxa/dsp/dsp_flights"
+	"github.com/clixxa/dsp/rtb_types"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fires synthetic bid requests at Target, the way an ssp would. A WinRate share of the bids get their
+// win notice called, at a clearing price between half and all of the bid.
+type Config struct {
+	Target      string
+	Rate        int
+	Concurrency int
+	Duration    time.Duration
+	WinRate     float64
+	Seed        int64
+}
+
+type Result struct {
+	Requests  int           `json:"requests"`
+	Bids      int           `json:"bids"`
+	NoBids    int           `json:"no_bids"`
+	Errors    int           `json:"errors"`
+	Wins      int           `json:"wins"`
+	WinErrors int           `json:"win_errors"`
+	P50       time.Duration `json:"p50_ns"`
+	P99       time.Duration `json:"p99_ns"`
+	Max       time.Duration `json:"max_ns"`
+	PerSecond float64       `json:"per_second"`
+}
+
+// Runs until Duration is up, Rate is requests per second across all workers with 0 being as fast as they go
+func Run(cfg Config, client *http.Client) *Result {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+
+	// workers pull from ticks so the rate holds however many there are
+	ticks := make(chan struct{}, cfg.Concurrency)
+	go func() {
+		defer close(ticks)
+		stop := time.After(cfg.Duration)
+		var every <-chan time.Time
+		if cfg.Rate > 0 {
+			t := time.NewTicker(time.Second / time.Duration(cfg.Rate))
+			defer t.Stop()
+			every = t.C
+		}
+		for {
+			if every != nil {
+				select {
+				case <-every:
+				case <-stop:
+					return
+				}
+			}
+			select {
+			case ticks <- struct{}{}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	mu := sync.Mutex{}
+	res := &Result{}
+	latencies := []time.Duration{}
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for w := 0; w < cfg.Concurrency; w++ {
+		wg.Add(1)
+		go func(r *rand.Rand) {
+			defer wg.Done()
+			for range ticks {
+				took, bid, err := bidOnce(client, cfg.Target, r)
+				won, winErr := false, error(nil)
+				if bid != nil && r.Float64() < cfg.WinRate {
+					won, winErr = true, win(client, bid, r)
+				}
+				mu.Lock()
+				res.Requests++
+				latencies = append(latencies, took)
+				switch {
+				case err != nil:
+					res.Errors++
+				case bid != nil:
+					res.Bids++
+				default:
+					res.NoBids++
+				}
+				if won && winErr == nil {
+					res.Wins++
+				} else if won {
+					res.WinErrors++
+				}
+				mu.Unlock()
+			}
+		}(rand.New(rand.NewSource(cfg.Seed + int64(w))))
+	}
+	wg.Wait()
+
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		res.P50 = Percentile(latencies, 50)
+		res.P99 = Percentile(latencies, 99)
+		res.Max = latencies[len(latencies)-1]
+	}
+	res.PerSecond = float64(res.Requests) / time.Since(start).Seconds()
+	return res
+}
+
+// The p-th percentile of sorted durations
+func Percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+// Sends one request, bid is nil when there wasn't one
+func bidOnce(client *http.Client, target string, r *rand.Rand) (time.Duration, *rtb_types.Bid, error) {
+	body := dsp_flights.SyntheticRequest(r)
+	start := time.Now()
+	resp, err := client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return time.Since(start), nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		io.Copy(ioutil.Discard, resp.Body)
+		return time.Since(start), nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return time.Since(start), nil, &StatusErr{resp.StatusCode}
+	}
+	out := rtb_types.Response{}
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	took := time.Since(start)
+	if err != nil {
+		return took, nil, err
+	}
+	if len(out.SeatBids) == 0 || len(out.SeatBids[0].Bids) == 0 {
+		return took, nil, nil
+	}
+	return took, &out.SeatBids[0].Bids[0], nil
+}
+
+// Calls the bid's win notice as the ssp would, filling in the auction macros
+func win(client *http.Client, bid *rtb_types.Bid, r *rand.Rand) error {
+	price := int(bid.Price * (0.5 + r.Float64()/2))
+	url := strings.NewReplacer(`${AUCTION_PRICE}`, strconv.Itoa(price), `${AUCTION_BID_ID}`, bid.ID, `${AUCTION_IMP_ID}`, "1").Replace(bid.WinUrl)
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &StatusErr{resp.StatusCode}
+	}
+	return nil
+}
+
+type StatusErr struct {
+	Code int
+}
+
+func (e *StatusErr) Error() string {
+	return "unexpected status " + strconv.Itoa(e.Code)
+}
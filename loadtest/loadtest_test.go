@@ -0,0 +1,49 @@
+package loadtest
+
+import (
+	"encoding/json"
+	"github.com/clixxa/dsp/rtb_types"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	var wins, bad int64
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	mux.HandleFunc("/7", func(w http.ResponseWriter, r *http.Request) {
+		req := rtb_types.Request{}
+		json.NewDecoder(r.Body).Decode(&req)
+		// bid on half
+		if req.Random255%2 == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		bid := rtb_types.Bid{ID: "42", Price: 100, WinUrl: srv.URL + `/win?price=${AUCTION_PRICE}&key=${AUCTION_BID_ID}&imp=${AUCTION_IMP_ID}`}
+		json.NewEncoder(w).Encode(rtb_types.Response{SeatBids: []rtb_types.SeatBid{{Bids: []rtb_types.Bid{bid}}}})
+	})
+	mux.HandleFunc("/win", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		price, _ := strconv.Atoi(q.Get("price"))
+		if q.Get("key") != "42" || q.Get("imp") != "1" || price < 50 || price > 100 {
+			atomic.AddInt64(&bad, 1)
+		}
+		atomic.AddInt64(&wins, 1)
+	})
+
+	res := Run(Config{Target: srv.URL + "/7", Concurrency: 2, Duration: 200 * time.Millisecond, WinRate: 1}, nil)
+	if res.Requests == 0 || res.Bids == 0 || res.NoBids == 0 || res.Errors != 0 {
+		t.Error("wrong counts", res)
+	}
+	if int64(res.Wins) != atomic.LoadInt64(&wins) || res.Wins != res.Bids || atomic.LoadInt64(&bad) != 0 {
+		t.Error("win notices wrong", res, wins, bad)
+	}
+	if res.P50 <= 0 || res.P99 < res.P50 || res.Max < res.P99 {
+		t.Error("wrong latencies", res)
+	}
+}
@@ -1,30 +1,75 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
+	"expvar"
 	"fmt"
+	"github.com/clixxa/dsp/admin"
+	"github.com/clixxa/dsp/bindings"
 	"github.com/clixxa/dsp/dsp_flights"
+	"github.com/clixxa/dsp/loadtest"
+	"github.com/clixxa/dsp/postback_flights"
+	"github.com/clixxa/dsp/replay"
+	"github.com/clixxa/dsp/reporting"
 	"github.com/clixxa/dsp/services"
 	"github.com/clixxa/dsp/wish_flights"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Main struct {
-	TestOnly bool
+	TestOnly   bool
+	ConfigFile string
+	// bid from this snapshot file with no databases, see dsp_flights.Snapshot
+	Snapshot string
+}
+
+func (m *Main) Config() services.ConfigProvider {
+	if m.ConfigFile != "" {
+		return &services.FileConfigs{Path: m.ConfigFile}
+	}
+	return &services.ConsulConfigs{}
 }
 
 func (m *Main) Launch() {
-	consul := &services.ConsulConfigs{}
-	deps := &services.ProductionDepsService{Consul: consul}
+	config := m.Config()
+	deps := &services.ProductionDepsService{Config: config, Offline: m.Snapshot != ""}
 
-	dspRuntime := &dsp_flights.BidEntrypoint{AllTest: m.TestOnly, Logic: dsp_flights.SimpleLogic{}}
-	winRuntime := &wish_flights.WishEntrypoint{}
+	dspRuntime := &dsp_flights.BidEntrypoint{AllTest: m.TestOnly, Logic: dsp_flights.SimpleLogic{}, Snapshot: m.Snapshot}
+	debugNets, err := dsp_flights.ParseDebugNets(os.Getenv("TDEBUGNETS"))
+	if err != nil {
+		log.Fatal("invalid TDEBUGNETS: ", err.Error())
+	}
+	dspRuntime.DebugNets = debugNets
+	winRuntime := &wish_flights.WishEntrypoint{SkipWork: m.Snapshot != ""}
+	postbackRuntime := &postback_flights.PostbackEntrypoint{}
+	cpaRuntime := &postback_flights.CPAEntrypoint{}
+	switches := &services.SwitchService{Config: config}
+	adminAPI := &admin.API{}
+	reportRuntime := &reporting.ReportEntrypoint{}
+	rollups := &services.RollupService{Config: config}
 
 	router := &services.RouterService{}
 	router.Mux = http.NewServeMux()
 	router.Mux.Handle("/", dspRuntime)
 	router.Mux.Handle("/win", winRuntime)
+	// ssps post to this listener too, so the counters and memstats need the admin token
+	router.Mux.Handle("/debug/vars", services.RequireToken(expvar.Handler()))
+	router.Mux.Handle("/admin/switches", services.RequireToken(switches))
+	// the rest need the databases
+	if m.Snapshot == "" {
+		// the click token authenticates postbacks, the cpa report shows every folder's spend
+		router.Mux.Handle("/postback", postbackRuntime)
+		router.Mux.Handle("/cpa", services.RequireToken(cpaRuntime))
+		router.Mux.Handle("/admin/", services.RequireToken(adminAPI))
+		router.Mux.Handle("/report", services.RequireToken(reportRuntime))
+	}
 
 	cycler := &services.CycleService{}
 	cycler.BindingDeps.Logger = log.New(os.Stdout, "INIT ", log.Lshortfile|log.Ltime)
@@ -34,31 +79,218 @@ func (m *Main) Launch() {
 	wireUp := &services.CycleService{Proxy: func() error {
 		dspRuntime.BindingDeps = deps.BindingDeps
 		winRuntime.BindingDeps = deps.BindingDeps
+		postbackRuntime.BindingDeps = deps.BindingDeps
+		cpaRuntime.BindingDeps = deps.BindingDeps
+		switches.BindingDeps = deps.BindingDeps
+		adminAPI.BindingDeps = deps.BindingDeps
+		reportRuntime.BindingDeps = deps.BindingDeps
+		rollups.BindingDeps = deps.BindingDeps
 		cycler.BindingDeps = deps.BindingDeps
 		router.BindingDeps = deps.BindingDeps
 		launch.BindingDeps = deps.BindingDeps
 		return nil
 	}}
 
-	cycler.Children = append(cycler.Children, consul, deps, wireUp, dspRuntime, winRuntime)
-	launch.Children = append(launch.Children, cycler, router)
+	cycler.Children = append(cycler.Children, config, deps, wireUp, dspRuntime, winRuntime)
+	if m.Snapshot == "" {
+		cycler.Children = append(cycler.Children, postbackRuntime, reportRuntime, rollups)
+	}
+	// config changes are picked up straight away rather than on the next minute
+	config.Subscribe("ms/", func(key, value string) { cycler.Kick() })
+	launch.Children = append(launch.Children, cycler, config, router)
 
 	fmt.Println("starting launcher")
 	launch.Launch()
 }
 
 func NewMain() *Main {
-	m := &Main{}
+	m := &Main{ConfigFile: os.Getenv("TCONFIGFILE"), Snapshot: os.Getenv("TSNAPSHOT")}
 	for _, flag := range os.Args[1:] {
 		fmt.Printf(`arg %s`, flag)
-		switch flag {
-		case "test":
+		switch {
+		case flag == "test":
 			m.TestOnly = true
+		case strings.HasPrefix(flag, "config="):
+			m.ConfigFile = strings.TrimPrefix(flag, "config=")
+		case strings.HasPrefix(flag, "snapshot="):
+			m.Snapshot = strings.TrimPrefix(flag, "snapshot=")
 		}
 	}
 	return m
 }
 
+// dsp audit {bidid} {files or dirs..} prints the audit entries for a request or bid id
+func auditCmd(args []string) {
+	if len(args) < 2 || args[0] == "" {
+		fmt.Fprintln(os.Stderr, "usage: dsp audit {bidid} {files or dirs..}")
+		os.Exit(2)
+	}
+	n, err := bindings.SearchAudit(args[0], args[1:], os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if n == 0 {
+		fmt.Fprintln(os.Stderr, "no entries for", args[0])
+		os.Exit(1)
+	}
+}
+
+// Reads the folders, creatives, users and pseudonyms from the snapshot if there is one, otherwise from ConfigDB once
+func (m *Main) Storage() (*dsp_flights.Storage, error) {
+	if m.Snapshot != "" {
+		storage := &dsp_flights.Storage{}
+		return storage, storage.LoadSnapshot(m.Snapshot)
+	}
+	config := m.Config()
+	if err := config.Cycle(); err != nil {
+		if _, ok := err.(services.ErrAllowed); !ok {
+			return nil, err
+		}
+	}
+	dsn := (&services.ProductionDepsService{Config: config}).ConfigDSN()
+	db, err := sql.Open(dsn.Driver, dsn.Dump())
+	if err != nil {
+		return nil, err
+	}
+	quiet := log.New(ioutil.Discard, "", 0)
+	storage := &dsp_flights.Storage{}
+	return storage, storage.Load(bindings.BindingDeps{ConfigDB: db, Logger: quiet, Debug: quiet})
+}
+
+// dsp replay {captured.ndjson} [logic=simple] [against=highest] [config=file.json] [snapshot=file.json] replays
+// captured requests through the named logics against ConfigDB or a snapshot and prints a json summary
+func replayCmd(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: dsp replay {captured.ndjson} [logic=simple] [against=highest] [config=file.json] [snapshot=file.json]")
+		os.Exit(2)
+	}
+	m := &Main{ConfigFile: os.Getenv("TCONFIGFILE"), Snapshot: os.Getenv("TSNAPSHOT")}
+	logic, against := "simple", ""
+	for _, flag := range args[1:] {
+		switch {
+		case strings.HasPrefix(flag, "logic="):
+			logic = strings.TrimPrefix(flag, "logic=")
+		case strings.HasPrefix(flag, "against="):
+			against = strings.TrimPrefix(flag, "against=")
+		case strings.HasPrefix(flag, "config="):
+			m.ConfigFile = strings.TrimPrefix(flag, "config=")
+		case strings.HasPrefix(flag, "snapshot="):
+			m.Snapshot = strings.TrimPrefix(flag, "snapshot=")
+		}
+	}
+	for _, name := range []string{logic, against} {
+		if _, found := dsp_flights.Logics[name]; name != "" && !found {
+			fmt.Fprintln(os.Stderr, "unknown logic", name)
+			os.Exit(2)
+		}
+	}
+
+	storage, err := m.Storage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "loading storage:", err.Error())
+		os.Exit(1)
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	a := &replay.Replayer{Name: logic, Storage: *storage, Logic: dsp_flights.Logics[logic]}
+	var b *replay.Replayer
+	if against != "" {
+		b = &replay.Replayer{Name: against, Storage: *storage, Logic: dsp_flights.Logics[against]}
+	}
+	summary, err := replay.Compare(f, a, b)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	out.Encode(summary)
+}
+
+// dsp snapshot {out.json} [config=file.json] writes ConfigDB's folders, creatives, users and pseudonyms to a snapshot
+func snapshotCmd(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: dsp snapshot {out.json} [config=file.json]")
+		os.Exit(2)
+	}
+	m := &Main{ConfigFile: os.Getenv("TCONFIGFILE")}
+	for _, flag := range args[1:] {
+		if strings.HasPrefix(flag, "config=") {
+			m.ConfigFile = strings.TrimPrefix(flag, "config=")
+		}
+	}
+	storage, err := m.Storage()
+	if err == nil {
+		err = storage.SaveSnapshot(args[0])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("wrote %d folders, %d creatives and %d users to %s\n", len(storage.Folders), len(storage.Creatives), len(storage.Users), args[0])
+}
+
+// dsp loadtest [url=http://localhost:8080/1] [rate=0] [concurrency=8] [duration=30s] [wins=0.5] fires synthetic
+// bid requests at a running dsp, calling the win notice for a share of the bids, and prints the latencies
+func loadtestCmd(args []string) {
+	cfg := loadtest.Config{Target: "http://localhost:8080/1", Concurrency: 8, Duration: 30 * time.Second, WinRate: 0.5, Seed: time.Now().UnixNano()}
+	var err error
+	for _, flag := range args {
+		kv := strings.SplitN(flag, "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("expected key=value, got %s", flag)
+			break
+		}
+		switch kv[0] {
+		case "url":
+			cfg.Target = kv[1]
+		case "rate":
+			cfg.Rate, err = strconv.Atoi(kv[1])
+		case "concurrency":
+			cfg.Concurrency, err = strconv.Atoi(kv[1])
+		case "duration":
+			cfg.Duration, err = time.ParseDuration(kv[1])
+		case "wins":
+			cfg.WinRate, err = strconv.ParseFloat(kv[1], 64)
+		default:
+			err = fmt.Errorf("unknown option %s", kv[0])
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		fmt.Fprintln(os.Stderr, "usage: dsp loadtest [url=http://localhost:8080/1] [rate=0] [concurrency=8] [duration=30s] [wins=0.5]")
+		os.Exit(2)
+	}
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	out.Encode(loadtest.Run(cfg, nil))
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "audit":
+			auditCmd(os.Args[2:])
+			return
+		case "replay":
+			replayCmd(os.Args[2:])
+			return
+		case "snapshot":
+			snapshotCmd(os.Args[2:])
+			return
+		case "loadtest":
+			loadtestCmd(os.Args[2:])
+			return
+		}
+	}
 	NewMain().Launch()
 }
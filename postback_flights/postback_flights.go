@@ -0,0 +1,258 @@
+package postback_flights
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/clixxa/dsp/bindings"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Uses environment variables and real database connections to create Runtimes
+type PostbackEntrypoint struct {
+	postbackFlight atomic.Value
+	BindingDeps    bindings.BindingDeps
+}
+
+func (e *PostbackEntrypoint) Cycle() error {
+	// create template postback flight
+	pf := &PostbackFlight{}
+	if old, found := e.postbackFlight.Load().(*PostbackFlight); found {
+		e.BindingDeps.Debug.Println("using old runtime")
+		pf.Runtime = old.Runtime
+	} else {
+		pf.Runtime.Logger = e.BindingDeps.Logger
+		pf.Runtime.Logger.Println("brand new runtime")
+		pf.Runtime.Debug = e.BindingDeps.Debug
+		pf.Runtime.Storage.Conversions = bindings.Conversions{Env: e.BindingDeps}.Save
+	}
+
+	// keys can rotate between cycles
+	pf.Runtime.DefaultTokens = e.BindingDeps.DefaultTokens
+
+	users := bindings.Users{}
+	if err := users.Unmarshal(1, e.BindingDeps); err != nil {
+		e.BindingDeps.Debug.Println("err:", err.Error())
+		return err
+	}
+	pf.Runtime.Storage.Users = users
+
+	e.postbackFlight.Store(pf)
+	return nil
+}
+
+func (e *PostbackEntrypoint) PostbackFlight() *PostbackFlight {
+	sf := e.postbackFlight.Load().(*PostbackFlight)
+	flight := &PostbackFlight{}
+	flight.Runtime = sf.Runtime
+	return flight
+}
+
+func (e *PostbackEntrypoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request := e.PostbackFlight()
+	request.HttpRequest = r
+	request.HttpResponse = w
+	request.Launch()
+}
+
+type PostbackFlight struct {
+	Runtime struct {
+		DefaultTokens *bindings.TokenCodec
+		Storage       struct {
+			Users       bindings.Users
+			Conversions func([4]interface{}, *bool, *error)
+		}
+		Logger *log.Logger
+		Debug  *log.Logger
+	} `json:"-"`
+
+	HttpRequest  *http.Request       `json:"-"`
+	HttpResponse http.ResponseWriter `json:"-"`
+
+	ClickID    string
+	UserID     int
+	RecallID   int
+	FolderID   int
+	CreativeID int
+	Event      string
+	Payout     int
+	Duplicate  bool
+	StartTime  time.Time
+
+	Invalid error `json:"-"`
+	Error   error `json:"-"`
+}
+
+func (pf *PostbackFlight) String() string {
+	e := ""
+	if pf.Invalid != nil {
+		e = pf.Invalid.Error()
+	}
+	if pf.Error != nil {
+		e = pf.Error.Error()
+	}
+	return fmt.Sprintf(`postbackflight id%d err%s`, pf.RecallID, e)
+}
+
+func (pf *PostbackFlight) Launch() {
+	defer func() {
+		if err := recover(); err != nil {
+			pf.Runtime.Logger.Println("uncaught panic, stack trace following", err)
+			s := debug.Stack()
+			pf.Runtime.Logger.Println(string(s))
+		}
+	}()
+	ReadPostback(pf)
+	ProcessPostback(pf)
+	WritePostbackResponse(pf)
+}
+
+func (pf *PostbackFlight) Columns() [4]interface{} {
+	return [4]interface{}{pf.RecallID, pf.UserID, pf.Event, pf.Payout}
+}
+
+// The keys used to encrypt the click id, the advertiser's when they have them
+func (pf *PostbackFlight) Tokens() *bindings.TokenCodec {
+	if user := pf.Runtime.Storage.Users.ByID(pf.UserID); user != nil && user.Tokens != nil {
+		return user.Tokens
+	}
+	return pf.Runtime.DefaultTokens
+}
+
+// Decrypts a {clickid} back into the recall id it was made from
+func DecryptClickID(c *bindings.TokenCodec, clickid string) (int, error) {
+	pt, err := c.Open(clickid)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(pt))
+}
+
+func ReadPostback(flight *PostbackFlight) {
+	flight.StartTime = time.Now()
+	flight.Runtime.Logger.Println(`starting ReadPostback`, flight.String())
+
+	u, e := url.ParseRequestURI(flight.HttpRequest.RequestURI)
+	if e != nil {
+		flight.Invalid = e
+		flight.Runtime.Logger.Println(`postback url not valid`, e.Error())
+		return
+	}
+	q := u.Query()
+
+	if user := q.Get("user"); user != "" {
+		if id, e := strconv.Atoi(user); e != nil {
+			flight.Invalid = e
+			flight.Runtime.Logger.Println(`postback user not valid`, e.Error())
+			return
+		} else {
+			flight.UserID = id
+		}
+	}
+
+	flight.ClickID = q.Get("clickid")
+	if flight.ClickID == "" {
+		flight.ClickID = q.Get("ct")
+	}
+	if flight.ClickID == "" {
+		flight.Invalid = fmt.Errorf(`missing clickid`)
+		flight.Runtime.Logger.Println(`postback missing clickid`)
+		return
+	}
+	if tok, e := bindings.DecodeClickToken(flight.Tokens(), flight.ClickID); e == nil {
+		flight.RecallID = tok.RecallID
+		flight.FolderID = tok.FolderID
+		flight.CreativeID = tok.CreativeID
+		flight.Runtime.Logger.Printf(`got recallid %d from ct, folder %d creative %d clicked %s`, tok.RecallID, tok.FolderID, tok.CreativeID, tok.Time)
+	} else if id, e := DecryptClickID(flight.Tokens(), flight.ClickID); e != nil {
+		flight.Invalid = e
+		flight.Runtime.Logger.Println(`postback clickid not valid`, e.Error())
+		return
+	} else {
+		flight.RecallID = id
+		flight.Runtime.Logger.Printf(`got recallid %d`, flight.RecallID)
+	}
+
+	flight.Event = q.Get("event")
+	if flight.Event == "" {
+		flight.Event = "conversion"
+	}
+
+	if p := q.Get("payout"); p != "" {
+		if payout, e := strconv.ParseFloat(p, 64); e != nil {
+			flight.Invalid = e
+			flight.Runtime.Logger.Println(`postback payout not valid`, e.Error())
+			return
+		} else {
+			// payouts come in as dollars, stored in the same units as cpc
+			flight.Payout = int(payout * 100000)
+		}
+	}
+}
+
+func ProcessPostback(flight *PostbackFlight) {
+	if flight.Invalid != nil {
+		return
+	}
+	flight.Runtime.Logger.Printf(`saving conversion %s for %d`, flight.Event, flight.RecallID)
+	flight.Runtime.Storage.Conversions(flight.Columns(), &flight.Duplicate, &flight.Error)
+	if flight.Duplicate {
+		flight.Runtime.Logger.Printf(`conversion %s for %d already recorded`, flight.Event, flight.RecallID)
+	}
+}
+
+func WritePostbackResponse(flight *PostbackFlight) {
+	if flight.Invalid != nil {
+		flight.Runtime.Logger.Printf(`invalid postback, returning 400: %s`, flight.Invalid.Error())
+		flight.HttpResponse.WriteHeader(http.StatusBadRequest)
+	} else if flight.Error != nil {
+		flight.Runtime.Logger.Printf(`!! got an error handling postback !! %s !!`, flight.Error.Error())
+		flight.HttpResponse.WriteHeader(http.StatusInternalServerError)
+	} else {
+		flight.HttpResponse.WriteHeader(http.StatusOK)
+	}
+	flight.Runtime.Logger.Println(`dsp /postback took`, time.Since(flight.StartTime))
+}
+
+// Serves the spend and conversions per folder as json
+type CPAEntrypoint struct {
+	BindingDeps bindings.BindingDeps
+}
+
+func (e *CPAEntrypoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	if s := q.Get("from"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if s := q.Get("to"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+
+	report, err := bindings.Conversions{Env: e.BindingDeps}.Report(from, to, q.Get("event"))
+	if err != nil {
+		e.BindingDeps.Logger.Println(`err building cpa report`, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(`Content-Type`, `application/json`)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		e.BindingDeps.Logger.Println(`err writing cpa report`, err.Error())
+	}
+}
@@ -0,0 +1,83 @@
+package postback_flights
+
+import (
+	"github.com/clixxa/dsp/bindings"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPostbackUserKey(t *testing.T) {
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+
+	flight := &PostbackFlight{}
+	flight.Runtime.Logger = l
+	flight.Runtime.DefaultTokens = bindings.NewTokenCodec(&bindings.B64{Key: []byte("gekk"), IV: []byte("whatwhat")})
+	uid := flight.Runtime.Storage.Users.Add(&bindings.User{Tokens: bindings.NewTokenCodec(&bindings.B64{Key: []byte("user"), IV: []byte("whatwhat")})})
+
+	var saved [4]interface{}
+	flight.Runtime.Storage.Conversions = func(cols [4]interface{}, dup *bool, err *error) {
+		saved = cols
+	}
+
+	clickid, _ := flight.Runtime.Storage.Users.ByID(uid).Tokens.Seal([]byte("1234"))
+	flight.HttpRequest = httptest.NewRequest("GET", "/postback?user=1&event=sale&payout=1.5&clickid="+clickid, nil)
+	rec := httptest.NewRecorder()
+	flight.HttpResponse = rec
+	flight.Launch()
+
+	if rec.Code != 200 {
+		t.Error("expected 200, got", rec.Code, flight.String())
+	}
+	if saved != [4]interface{}{1234, uid, "sale", 150000} {
+		t.Error("unexpected columns", saved)
+	}
+}
+
+func TestPostbackBadClickID(t *testing.T) {
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+
+	flight := &PostbackFlight{}
+	flight.Runtime.Logger = l
+	flight.Runtime.DefaultTokens = bindings.NewTokenCodec(&bindings.B64{Key: []byte("gekk"), IV: []byte("whatwhat")})
+	flight.Runtime.Storage.Conversions = func(cols [4]interface{}, dup *bool, err *error) {
+		t.Error("shouldn't save an invalid postback")
+	}
+
+	flight.HttpRequest = httptest.NewRequest("GET", "/postback?clickid=abc", nil)
+	rec := httptest.NewRecorder()
+	flight.HttpResponse = rec
+	flight.Launch()
+
+	if rec.Code != 400 {
+		t.Error("expected 400, got", rec.Code)
+	}
+}
+
+func TestPostbackClickToken(t *testing.T) {
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+
+	flight := &PostbackFlight{}
+	flight.Runtime.Logger = l
+	flight.Runtime.DefaultTokens = bindings.NewTokenCodec(&bindings.B64{Key: []byte("gekk"), IV: []byte("whatwhat")})
+
+	var saved [4]interface{}
+	flight.Runtime.Storage.Conversions = func(cols [4]interface{}, dup *bool, err *error) {
+		saved = cols
+	}
+
+	ct, _ := bindings.ClickToken{RecallID: 99, FolderID: 3, CreativeID: 4}.Encode(flight.Runtime.DefaultTokens)
+	flight.HttpRequest = httptest.NewRequest("GET", "/postback?ct="+ct, nil)
+	rec := httptest.NewRecorder()
+	flight.HttpResponse = rec
+	flight.Launch()
+
+	if rec.Code != 200 {
+		t.Error("expected 200, got", rec.Code, flight.String())
+	}
+	if saved[0] != 99 || flight.FolderID != 3 || flight.CreativeID != 4 {
+		t.Error("token not decoded", saved, flight.FolderID, flight.CreativeID)
+	}
+}
@@ -0,0 +1,195 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"github.com/clixxa/dsp/bindings"
+	"github.com/clixxa/dsp/dsp_flights"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+)
+
+// How many differing requests a summary lists, the rest are only counted
+const MaxDiffs = 100
+
+// A captured bid request, from a line of the audit log or a bare request body
+type Captured struct {
+	Line  int
+	SspID int
+	Body  []byte
+}
+
+// Calls fn with each captured request in r. Audit log lines are recognised by their body field, other
+// lines are taken as the request itself from ssp 0.
+func Each(r io.Reader, fn func(Captured)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		var entry struct {
+			Body  *string `json:"body"`
+			SspID int     `json:"ssp"`
+		}
+		if json.Unmarshal(b, &entry) == nil && entry.Body != nil {
+			fn(Captured{Line: line, SspID: entry.SspID, Body: []byte(*entry.Body)})
+		} else {
+			fn(Captured{Line: line, Body: append([]byte(nil), b...)})
+		}
+	}
+	return scanner.Err()
+}
+
+// What a request got
+type Result struct {
+	Bid        bool    `json:"bid"`
+	FolderID   int     `json:"folder,omitempty"`
+	CreativeID int     `json:"creative,omitempty"`
+	Price      float64 `json:"price,omitempty"`
+	Status     int     `json:"status"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Runs captured requests through the DemandFlight pipeline over Storage. Recalls are numbered rather
+// than saved and click tokens are sealed with throwaway keys, nothing leaves the process.
+type Replayer struct {
+	Name    string
+	Storage dsp_flights.Storage
+	Logic   dsp_flights.BiddingLogic
+	Logger  *log.Logger
+
+	recalls  int64
+	template *dsp_flights.DemandFlight
+}
+
+func (r *Replayer) flight() *dsp_flights.DemandFlight {
+	if r.template == nil {
+		logger := r.Logger
+		if logger == nil {
+			logger = log.New(ioutil.Discard, "", 0)
+		}
+		df := &dsp_flights.DemandFlight{}
+		df.Runtime.Storage = r.Storage
+		df.Runtime.Storage.Recalls = func(_ encoding.BinaryMarshaler, _ int, _ *error, id *int) {
+			*id = int(atomic.AddInt64(&r.recalls, 1))
+		}
+		df.Runtime.Logic = r.Logic
+		df.Runtime.Logger, df.Runtime.Debug = logger, logger
+		df.Runtime.DefaultTokens = bindings.NewTokenCodec(&bindings.B64{Key: []byte("replay"), IV: []byte("replayiv")})
+		r.template = df
+	}
+	flight := &dsp_flights.DemandFlight{}
+	flight.Runtime = r.template.Runtime
+	return flight
+}
+
+func (r *Replayer) Run(c Captured) Result {
+	flight := r.flight()
+	flight.HttpRequest = httptest.NewRequest("POST", "/"+strconv.Itoa(c.SspID), bytes.NewReader(c.Body))
+	rec := httptest.NewRecorder()
+	flight.HttpResponse = rec
+	flight.Launch()
+
+	res := Result{Status: rec.Code}
+	if flight.Error != nil {
+		res.Error = flight.Error.Error()
+	} else if flight.Invalid != nil {
+		res.Error = flight.Invalid.Error()
+	}
+	if rec.Code == http.StatusOK && len(flight.Response.SeatBids) > 0 {
+		res.Bid = true
+		res.FolderID, res.CreativeID = flight.FolderID, flight.CreativeID
+		res.Price = flight.Response.SeatBids[0].Bids[0].Price
+	}
+	return res
+}
+
+// Totals for one logic, prices are in the same units as the bids
+type Report struct {
+	Logic    string      `json:"logic"`
+	Requests int         `json:"requests"`
+	Bids     int         `json:"bids"`
+	Errors   int         `json:"errors"`
+	BidRate  float64     `json:"bid_rate"`
+	AvgPrice float64     `json:"avg_price"`
+	Folders  map[int]int `json:"folders"`
+
+	spent float64
+}
+
+func (r *Report) Add(res Result) {
+	if r.Folders == nil {
+		r.Folders = map[int]int{}
+	}
+	r.Requests++
+	if res.Error != "" {
+		r.Errors++
+	}
+	if !res.Bid {
+		return
+	}
+	r.Bids++
+	r.spent += res.Price
+	r.Folders[res.FolderID]++
+}
+
+func (r *Report) finish() {
+	if r.Requests > 0 {
+		r.BidRate = float64(r.Bids) / float64(r.Requests)
+	}
+	if r.Bids > 0 {
+		r.AvgPrice = r.spent / float64(r.Bids)
+	}
+}
+
+type Diff struct {
+	Line int    `json:"line"`
+	A    Result `json:"a"`
+	B    Result `json:"b"`
+}
+
+type Summary struct {
+	A         *Report `json:"a"`
+	B         *Report `json:"b,omitempty"`
+	Differing int     `json:"differing,omitempty"`
+	Diffs     []Diff  `json:"diffs,omitempty"`
+}
+
+// Replays every request in in through a, and through b too when it's given, listing where they disagree
+func Compare(in io.Reader, a, b *Replayer) (*Summary, error) {
+	s := &Summary{A: &Report{Logic: a.Name}}
+	if b != nil {
+		s.B = &Report{Logic: b.Name}
+	}
+	err := Each(in, func(c Captured) {
+		ra := a.Run(c)
+		s.A.Add(ra)
+		if b == nil {
+			return
+		}
+		rb := b.Run(c)
+		s.B.Add(rb)
+		if ra.Bid != rb.Bid || ra.FolderID != rb.FolderID || ra.CreativeID != rb.CreativeID || ra.Price != rb.Price {
+			s.Differing++
+			if len(s.Diffs) < MaxDiffs {
+				s.Diffs = append(s.Diffs, Diff{Line: c.Line, A: ra, B: rb})
+			}
+		}
+	})
+	s.A.finish()
+	if s.B != nil {
+		s.B.finish()
+	}
+	return s, err
+}
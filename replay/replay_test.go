@@ -0,0 +1,41 @@
+package replay
+
+import (
+	"github.com/clixxa/dsp/bindings"
+	"github.com/clixxa/dsp/dsp_flights"
+	"strings"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	storage := dsp_flights.Storage{}
+	storage.Pseudonyms.Countries = map[string]int{"CA": 3}
+	cr := storage.Creatives.Add(&bindings.Creative{RedirectUrl: `http://x.com/?id=${AUCTION_BID_ID}`})
+	cheap := storage.Folders.Add(&bindings.Folder{Active: true, Creative: []int{cr}, CPC: 100, Country: []int{3}})
+	dear := storage.Folders.Add(&bindings.Folder{Active: true, Creative: []int{cr}, CPC: 300})
+
+	captured := strings.Join([]string{
+		// an audit log line, rand 0 makes simple pick the first folder
+		`{"id": "r1", "ssp": 7, "body": "{\"imp\": [{\"id\": \"i1\"}], \"device\": {\"geo\": {\"country\": \"CA\"}}}"}`,
+		// a bare request only the dear folder matches
+		`{"imp": [{"id": "i1"}], "device": {"geo": {"country": "US"}}}`,
+		``,
+		`not json`,
+	}, "\n")
+
+	a := &Replayer{Name: "simple", Storage: storage, Logic: dsp_flights.SimpleLogic{}}
+	b := &Replayer{Name: "highest", Storage: storage, Logic: dsp_flights.HighestLogic{}}
+	s, err := Compare(strings.NewReader(captured), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.A.Requests != 3 || s.A.Bids != 2 || s.A.Errors != 1 || s.A.Folders[cheap] != 1 || s.A.Folders[dear] != 1 {
+		t.Error("wrong simple report", s.A)
+	}
+	if s.B.Bids != 2 || s.B.Folders[dear] != 2 || s.B.AvgPrice != 294 {
+		t.Error("wrong highest report", s.B)
+	}
+	if s.Differing != 1 || s.Diffs[0].Line != 1 || s.Diffs[0].A.FolderID != cheap || s.Diffs[0].B.FolderID != dear {
+		t.Error("wrong diffs", s.Diffs)
+	}
+}
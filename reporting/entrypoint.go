@@ -0,0 +1,88 @@
+package reporting
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/clixxa/dsp/bindings"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Serves /report?from=2017-03-01&to=2017-03-02&bucket=day&by=folder,country&format=csv
+// from and to are dates or RFC3339 times widened out to whole hours, and default to the 24 hours up to the end
+// of the current one. bucket defaults to day and format to json.
+type ReportEntrypoint struct {
+	BindingDeps bindings.BindingDeps
+	pseudonyms  atomic.Value
+}
+
+// Reloads the labels
+func (e *ReportEntrypoint) Cycle() error {
+	names := &bindings.Pseudonyms{}
+	if err := names.Unmarshal(1, e.BindingDeps); err != nil {
+		e.BindingDeps.Debug.Println("err:", err.Error())
+		return err
+	}
+	e.pseudonyms.Store(names)
+	return nil
+}
+
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func (e *ReportEntrypoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	q := Query{Bucket: v.Get("bucket"), IncludeTest: v.Get("test") == "true"}
+	if q.Bucket == "" {
+		q.Bucket = "day"
+	}
+	if by := v.Get("by"); by != "" {
+		q.By = strings.Split(by, ",")
+	}
+	var err error
+	// the end of the current hour, so the default range is whole hours too
+	end := time.Now().Truncate(time.Hour).Add(time.Hour)
+	if q.To, err = parseTime(v.Get("to"), end); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.From, err = parseTime(v.Get("from"), q.To.Add(-24*time.Hour)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q = q.WholeHours()
+	if err := q.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	names, _ := e.pseudonyms.Load().(*bindings.Pseudonyms)
+	report, err := Run(e.BindingDeps, q, names)
+	if err != nil {
+		e.BindingDeps.Logger.Println(`err building report`, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if v.Get("format") == "csv" {
+		w.Header().Set(`Content-Type`, `text/csv`)
+		w.Header().Set(`Content-Disposition`, `attachment; filename="report.csv"`)
+		if err := csv.NewWriter(w).WriteAll(Records(q, report)); err != nil {
+			e.BindingDeps.Logger.Println(`err writing report`, err.Error())
+		}
+		return
+	}
+	w.Header().Set(`Content-Type`, `application/json`)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		e.BindingDeps.Logger.Println(`err writing report`, err.Error())
+	}
+}
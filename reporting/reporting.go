@@ -0,0 +1,259 @@
+package reporting
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/clixxa/dsp/bindings"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The purchases columns a report can be grouped by
+var Dimensions = map[string]string{
+	"folder":      "folder_id",
+	"creative":    "creative_id",
+	"ssp":         "ssp_id",
+	"country":     "country_id",
+	"vertical":    "vertical_id",
+	"brand":       "brand_id",
+	"network":     "network_id",
+	"subnetwork":  "subnetwork_id",
+	"networktype": "networktype_id",
+	"gender":      "gender_id",
+	"devicetype":  "devicetype_id",
+}
+
+// Time buckets, "all" sums the whole range into one
+var Buckets = []string{"hour", "day", "week", "month", "all"}
+
+// Where a report reads from, the raw purchases or the hourly rollups of them. Args are for
+// placeholders in Name, numbered after the range's two.
+type Table struct {
+	Name string
+	Time string
+	Wins string
+	Args []interface{}
+}
+
+var Raw = Table{Name: "purchases", Time: "created_at", Wins: "COUNT(*)"}
+var Hourly = Table{Name: "purchases_hourly", Time: "hour", Wins: "COALESCE(SUM(wins), 0)"}
+
+// The rollups before until and the raw purchases from then on, for ranges running past the last rollup
+func Combined(until time.Time) Table {
+	cols := []string{"billable", "rev_tx", "rev_ssp"}
+	for _, dim := range DimensionNames() {
+		cols = append(cols, Dimensions[dim])
+	}
+	shared := strings.Join(cols, ", ")
+	name := `(SELECT hour AS at, wins, ` + shared + ` FROM purchases_hourly WHERE hour < $3` +
+		` UNION ALL SELECT created_at, 1, ` + shared + ` FROM purchases WHERE created_at >= $3) AS combined`
+	return Table{Name: name, Time: "at", Wins: "COALESCE(SUM(wins), 0)", Args: []interface{}{until}}
+}
+
+type Query struct {
+	From   time.Time
+	To     time.Time
+	Bucket string
+	By     []string
+	// test traffic isn't billed, so it's left out unless asked for
+	IncludeTest bool
+}
+
+type Row struct {
+	Bucket *time.Time        `json:"bucket,omitempty"`
+	IDs    map[string]int    `json:"ids"`
+	Labels map[string]string `json:"labels"`
+	Wins   int               `json:"wins"`
+	RevTX  int64             `json:"rev_tx"`
+	RevSSP int64             `json:"rev_ssp"`
+	Margin int64             `json:"margin"`
+}
+
+func (q Query) Validate() error {
+	if !q.From.Before(q.To) {
+		return fmt.Errorf(`from must be before to`)
+	}
+	found := false
+	for _, b := range Buckets {
+		found = found || b == q.Bucket
+	}
+	if !found {
+		return fmt.Errorf(`unknown bucket %s, expected one of %s`, q.Bucket, strings.Join(Buckets, ", "))
+	}
+	for _, dim := range q.By {
+		if _, found := Dimensions[dim]; !found {
+			return fmt.Errorf(`unknown dimension %s, expected one of %s`, dim, strings.Join(DimensionNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// Whether the range is on hour boundaries, so the rollups can answer it
+func (q Query) Aligned() bool {
+	return q.From.Equal(q.From.Truncate(time.Hour)) && q.To.Equal(q.To.Truncate(time.Hour))
+}
+
+// The range widened out to whole hours. The raw rows behind a partial hour may have been expired,
+// the rollups of whole hours are kept.
+func (q Query) WholeHours() Query {
+	q.From = q.From.Truncate(time.Hour)
+	if to := q.To.Truncate(time.Hour); to.Before(q.To) {
+		q.To = to.Add(time.Hour)
+	}
+	return q
+}
+
+// The rollups answer ranges on hour boundaries up to rolledUp, the latest hour in them, which is still
+// being filled in. Past that the raw rows make up the rest. Raw rows are expired only once rolled up,
+// so old ranges have to come from the rollups. rolledUp is nil when nothing is rolled up yet.
+func (q Query) Table(rolledUp *time.Time) Table {
+	switch {
+	case !q.Aligned() || rolledUp == nil || !q.From.Before(*rolledUp):
+		return Raw
+	case !q.To.After(*rolledUp):
+		return Hourly
+	default:
+		return Combined(*rolledUp)
+	}
+}
+
+// Builds the aggregate over the table, only whitelisted names are put into the sql itself
+func (q Query) SQL(t Table) (string, []interface{}) {
+	cols := []string{}
+	if q.Bucket != "all" {
+		cols = append(cols, `date_trunc('`+q.Bucket+`', `+t.Time+`)`)
+	}
+	for _, dim := range q.By {
+		cols = append(cols, Dimensions[dim])
+	}
+	where := t.Time + ` >= $1 AND ` + t.Time + ` < $2`
+	if !q.IncludeTest {
+		where += ` AND billable`
+	}
+
+	sql := `SELECT ` + strings.Join(append(cols, t.Wins, `COALESCE(SUM(rev_tx), 0)`, `COALESCE(SUM(rev_ssp), 0)`), `, `) + ` FROM ` + t.Name + ` WHERE ` + where
+	if len(cols) > 0 {
+		group := make([]string, len(cols))
+		for n := range cols {
+			group[n] = strconv.Itoa(n + 1)
+		}
+		sql += ` GROUP BY ` + strings.Join(group, `, `) + ` ORDER BY ` + strings.Join(group, `, `)
+	}
+	return sql, append([]interface{}{q.From, q.To}, t.Args...)
+}
+
+func Run(env bindings.BindingDeps, q Query, names *bindings.Pseudonyms) ([]*Row, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	var rolledUp *time.Time
+	if q.Aligned() {
+		if err := env.StatsDB.QueryRow(sqlRolledUp).Scan(&rolledUp); err != nil {
+			env.Debug.Println("err", err)
+			return nil, err
+		}
+	}
+	query, args := q.SQL(q.Table(rolledUp))
+	env.Debug.Println("report query", query)
+	rows, err := env.StatsDB.Query(query, args...)
+	if err != nil {
+		env.Debug.Println("err", err)
+		return nil, err
+	}
+	defer rows.Close()
+	return scan(rows, q, names)
+}
+
+func scan(rows *sql.Rows, q Query, names *bindings.Pseudonyms) ([]*Row, error) {
+	report := []*Row{}
+	for rows.Next() {
+		row := &Row{IDs: map[string]int{}, Labels: map[string]string{}}
+		ids := make([]int, len(q.By))
+		dest := []interface{}{}
+		if q.Bucket != "all" {
+			row.Bucket = &time.Time{}
+			dest = append(dest, row.Bucket)
+		}
+		for n := range ids {
+			dest = append(dest, &ids[n])
+		}
+		dest = append(dest, &row.Wins, &row.RevTX, &row.RevSSP)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for n, dim := range q.By {
+			row.IDs[dim] = ids[n]
+			row.Labels[dim] = Label(names, dim, ids[n])
+		}
+		row.Margin = row.RevTX - row.RevSSP
+		report = append(report, row)
+	}
+	return report, rows.Err()
+}
+
+// The name for a dimension's id, or the id itself for the ones without names (folders, creatives, ssps)
+func Label(names *bindings.Pseudonyms, dim string, id int) string {
+	var labels map[int]string
+	if names != nil {
+		switch dim {
+		case "country":
+			labels = names.CountryIDS
+		case "vertical":
+			labels = names.VerticalIDS
+		case "brand":
+			labels = names.BrandIDS
+		case "network":
+			labels = names.NetworkIDS
+		case "subnetwork":
+			labels = names.SubnetworkLabelIDS
+		case "networktype":
+			labels = names.NetworkTypeIDS
+		case "gender":
+			labels = names.GenderIDs
+		case "devicetype":
+			labels = names.DeviceTypeIDs
+		}
+	}
+	if label, found := labels[id]; found {
+		return label
+	}
+	return strconv.Itoa(id)
+}
+
+// Header and records for the csv output, each dimension gets an id and a label column
+func Records(q Query, report []*Row) [][]string {
+	header := []string{}
+	if q.Bucket != "all" {
+		header = append(header, "bucket")
+	}
+	for _, dim := range q.By {
+		header = append(header, dim+"_id", dim)
+	}
+	records := [][]string{append(header, "wins", "rev_tx", "rev_ssp", "margin")}
+	for _, row := range report {
+		rec := []string{}
+		if row.Bucket != nil {
+			rec = append(rec, row.Bucket.UTC().Format(time.RFC3339))
+		}
+		for _, dim := range q.By {
+			rec = append(rec, strconv.Itoa(row.IDs[dim]), row.Labels[dim])
+		}
+		rec = append(rec, strconv.Itoa(row.Wins), strconv.FormatInt(row.RevTX, 10), strconv.FormatInt(row.RevSSP, 10), strconv.FormatInt(row.Margin, 10))
+		records = append(records, rec)
+	}
+	return records
+}
+
+// Sorted list of the dimensions, for error messages and docs
+func DimensionNames() []string {
+	names := []string{}
+	for dim := range Dimensions {
+		names = append(names, dim)
+	}
+	sort.Strings(names)
+	return names
+}
+
+const sqlRolledUp = `SELECT MAX(hour) FROM purchases_hourly`
@@ -0,0 +1,126 @@
+package reporting
+
+import (
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/clixxa/dsp/bindings"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuerySQL(t *testing.T) {
+	from := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	q := Query{From: from, To: from.Add(48 * time.Hour), Bucket: "day", By: []string{"folder", "country"}}
+	rolledUp := from.Add(72 * time.Hour)
+	if q.Table(&rolledUp).Name != Hourly.Name {
+		t.Error("whole hours should use the rollups")
+	}
+	if q.Table(nil).Name != Raw.Name {
+		t.Error("nothing rolled up yet should use the raw rows")
+	}
+
+	// the rollups only reach the start of the second day, the rest comes from the raw rows
+	rolledUp = from.Add(24 * time.Hour)
+	combined := q.Table(&rolledUp)
+	sql, args := q.SQL(combined)
+	for _, part := range []string{`FROM purchases_hourly WHERE hour < $3 UNION ALL SELECT created_at, 1,`, `FROM purchases WHERE created_at >= $3) AS combined WHERE at >= $1 AND at < $2`, `COALESCE(SUM(wins), 0)`} {
+		if !strings.Contains(sql, part) {
+			t.Error("missing", part, "from", sql)
+		}
+	}
+	if len(args) != 3 || args[2] != rolledUp {
+		t.Error("wrong args", args)
+	}
+	rolledUp = from
+	if q.Table(&rolledUp).Name != Raw.Name {
+		t.Error("a range after the rollups should use the raw rows")
+	}
+
+	sql, args = q.SQL(Hourly)
+	for _, part := range []string{`date_trunc('day', hour), folder_id, country_id, COALESCE(SUM(wins), 0)`, `FROM purchases_hourly`, `AND billable`, `GROUP BY 1, 2, 3`} {
+		if !strings.Contains(sql, part) {
+			t.Error("missing", part, "from", sql)
+		}
+	}
+	if len(args) != 2 {
+		t.Error("wrong args", args)
+	}
+
+	q.Bucket, q.By, q.IncludeTest = "all", nil, true
+	q.To = q.To.Add(time.Minute)
+	if q.Table(&rolledUp).Name != Raw.Name {
+		t.Error("partial hours need the raw rows")
+	}
+	sql, _ = q.SQL(Raw)
+	if !strings.Contains(sql, "COUNT(*)") || !strings.Contains(sql, "FROM purchases WHERE") || strings.Contains(sql, "GROUP BY") || strings.Contains(sql, "billable") {
+		t.Error("totals shouldn't group or filter", sql)
+	}
+
+	for _, bad := range []Query{{From: from, To: from, Bucket: "day"}, {From: from, To: from.Add(time.Hour), Bucket: "year"}, {From: from, To: from.Add(time.Hour), Bucket: "day", By: []string{"created_at; DROP TABLE purchases"}}} {
+		if err := bad.Validate(); err == nil {
+			t.Error("accepted", bad)
+		}
+	}
+}
+
+func TestReportCSV(t *testing.T) {
+	db, sqlm, _ := sqlmock.New()
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+	e := &ReportEntrypoint{BindingDeps: bindings.BindingDeps{StatsDB: db, Logger: l, Debug: l}}
+	e.pseudonyms.Store(&bindings.Pseudonyms{CountryIDS: map[int]string{3: "AU"}})
+
+	day := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	sqlm.ExpectQuery("SELECT MAX\\(hour\\) FROM purchases_hourly").WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(day.Add(48 * time.Hour)))
+	sqlm.ExpectQuery("SELECT date_trunc.+FROM purchases_hourly WHERE").WillReturnRows(sqlmock.NewRows([]string{"bucket", "folder", "country", "wins", "rev_tx", "rev_ssp"}).AddRow(day, 12, 3, 4, 4000, 3000).AddRow(day, 12, 9, 1, 500, 400))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/report?from=2017-03-01&to=2017-03-02&by=folder,country&format=csv", nil))
+	want := "bucket,folder_id,folder,country_id,country,wins,rev_tx,rev_ssp,margin\n" +
+		"2017-03-01T00:00:00Z,12,12,3,AU,4,4000,3000,1000\n" +
+		"2017-03-01T00:00:00Z,12,12,9,9,1,500,400,100\n"
+	if rec.Code != 200 || rec.Body.String() != want {
+		t.Error("wrong report", rec.Code, rec.Body.String())
+	}
+	if err := sqlm.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/report?by=planet", nil))
+	if rec.Code != 400 {
+		t.Error("bad dimension accepted", rec.Code)
+	}
+}
+
+func TestReportWholeHours(t *testing.T) {
+	db, sqlm, _ := sqlmock.New()
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+	e := &ReportEntrypoint{BindingDeps: bindings.BindingDeps{StatsDB: db, Logger: l, Debug: l}}
+	rows := func() *sqlmock.Rows { return sqlmock.NewRows([]string{"bucket", "wins", "rev_tx", "rev_ssp"}) }
+
+	// the default last 24 hours ends with the current hour, and the rollups have it all
+	end := time.Now().Truncate(time.Hour).Add(time.Hour)
+	sqlm.ExpectQuery("SELECT MAX\\(hour\\) FROM purchases_hourly").WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(end))
+	sqlm.ExpectQuery("FROM purchases_hourly WHERE hour >= \\$1").WithArgs(end.Add(-24*time.Hour), end).WillReturnRows(rows())
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/report", nil))
+	if rec.Code != 200 {
+		t.Error("default report failed", rec.Code, rec.Body.String())
+	}
+
+	// partial hours are widened, their raw rows may be gone
+	day := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	sqlm.ExpectQuery("SELECT MAX\\(hour\\) FROM purchases_hourly").WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(day.Add(48 * time.Hour)))
+	sqlm.ExpectQuery("FROM purchases_hourly WHERE hour >= \\$1").WithArgs(day, day.Add(6*time.Hour)).WillReturnRows(rows())
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/report?from=2017-03-01T00:30:00Z&to=2017-03-01T05:10:00Z", nil))
+	if rec.Code != 200 {
+		t.Error("unaligned report failed", rec.Code, rec.Body.String())
+	}
+	if err := sqlm.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
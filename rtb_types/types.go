@@ -9,6 +9,7 @@ type Impression struct {
 }
 
 type Request struct {
+	ID          string       `json:"id"`
 	Random255   int          `json:"rand"`
 	Test        bool         `json:"test"`
 	Impressions []Impression `json:"imp"`
@@ -36,6 +37,7 @@ type Request struct {
 
 type Bid struct {
 	ID     string  `json:"id"`
+	ImpID  string  `json:"impid,omitempty"`
 	Price  float64 `json:"price"`
 	URL    string  `json:"rurl"`
 	WinUrl string  `json:"nurl"`
@@ -45,8 +47,16 @@ type SeatBid struct {
 	Bids []Bid `json:"bid"`
 }
 
+// OpenRTB no-bid reason codes
+const NoBidInvalidRequest = 2
+
 type Response struct {
-	SeatBids []SeatBid `json:"seatbid"`
+	SeatBids []SeatBid `json:"seatbid,omitempty"`
+	// only set on a 400, along with why the request was refused
+	NoBidReason int    `json:"nbr,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// only filled in for traced requests from internal callers
+	Debug interface{} `json:"debug,omitempty"`
 }
 
 type WinNotice struct {
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/clixxa/dsp/bindings"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const SwitchesKey = "ms/switches"
+
+// Only lets through requests with "Authorization: Bearer {TADMINTOKEN}", everything is refused if it's unset.
+// No token at all is a 401, a wrong one a 403.
+func RequireToken(h http.Handler) http.Handler {
+	token := os.Getenv("TADMINTOKEN")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		got := strings.TrimPrefix(auth, "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// GET shows the switches, PUT replaces them. The change reaches the bidders through the config provider.
+type SwitchService struct {
+	BindingDeps bindings.BindingDeps
+	Config      ConfigProvider
+}
+
+func (s *SwitchService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		sw, err := bindings.ParseSwitches(s.Config.Get(SwitchesKey))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(`Content-Type`, `application/json`)
+		json.NewEncoder(w).Encode(sw)
+	case "PUT", "POST":
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := bindings.ParseSwitches(string(body)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.Config.Set(SwitchesKey, string(body)); err != nil {
+			s.BindingDeps.Logger.Println("failed to save switches", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.BindingDeps.Logger.Println("switches set to", string(body), "by", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
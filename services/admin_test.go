@@ -0,0 +1,65 @@
+package services
+
+import (
+	"github.com/clixxa/dsp/bindings"
+	"github.com/clixxa/dsp/postback_flights"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSwitchService(t *testing.T) {
+	os.Setenv("TADMINTOKEN", "sekrit")
+	defer os.Unsetenv("TADMINTOKEN")
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+
+	config := &FileConfigs{}
+	kicked := ""
+	config.Subscribe("ms/", func(key, value string) { kicked = key })
+	h := RequireToken(&SwitchService{BindingDeps: bindings.BindingDeps{Logger: l}, Config: config})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("PUT", "/admin/switches", strings.NewReader(`{"global": 0}`)))
+	if rec.Code != 401 {
+		t.Error("no token should be refused, got", rec.Code)
+	}
+
+	put := func(body string) int {
+		r := httptest.NewRequest("PUT", "/admin/switches", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer sekrit")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	if code := put(`{"global": 500}`); code != 400 {
+		t.Error("invalid switches accepted", code)
+	}
+	if code := put(`{"global": 0}`); code != 204 || kicked != SwitchesKey {
+		t.Error("switches not saved", code, kicked)
+	}
+	if sw, _ := bindings.ParseSwitches(config.Get(SwitchesKey)); sw.SSPShare(3) != 0 {
+		t.Error("kill switch not stored", config.Get(SwitchesKey))
+	}
+}
+
+func TestRequireTokenCPA(t *testing.T) {
+	os.Unsetenv("TADMINTOKEN")
+	h := RequireToken(&postback_flights.CPAEntrypoint{})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/cpa", nil))
+	if rec.Code != 401 || rec.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Error("cpa report served without a token", rec.Code)
+	}
+
+	// with TADMINTOKEN unset no token is right
+	r := httptest.NewRequest("GET", "/cpa", nil)
+	r.Header.Set("Authorization", "Bearer guess")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != 403 {
+		t.Error("cpa report served with TADMINTOKEN unset", rec.Code)
+	}
+}
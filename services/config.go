@@ -0,0 +1,85 @@
+package services
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Where the ms/ keys (redis urls, dsns, keys, switches) come from, consul in production or a local file
+type ConfigProvider interface {
+	Cycle() error
+	Launch(chan error) error
+	Get(key string) string
+	Subscribe(prefix string, fn func(key, value string))
+	Service(name string) ([]string, error)
+	Set(key, value string) error
+}
+
+// The current keys, shared by the providers. Subscribers are called with each key that changes
+// (value "" when deleted).
+type configStore struct {
+	mu     sync.RWMutex
+	values map[string]string
+	subs   []configSubscription
+}
+
+type configSubscription struct {
+	prefix string
+	fn     func(key, value string)
+}
+
+func (c *configStore) loaded() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.values != nil
+}
+
+func (c *configStore) empty() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.values) == 0
+}
+
+// Replaces every key, then tells subscribers what changed
+func (c *configStore) set(next map[string]string) {
+	c.mu.Lock()
+	prev := c.values
+	c.values = next
+	subs := append([]configSubscription(nil), c.subs...)
+	c.mu.Unlock()
+
+	changed := []string{}
+	for key, val := range next {
+		if old, found := prev[key]; !found || old != val {
+			changed = append(changed, key)
+		}
+	}
+	for key := range prev {
+		if _, found := next[key]; !found {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	for _, key := range changed {
+		for _, sub := range subs {
+			if strings.HasPrefix(key, sub.prefix) {
+				sub.fn(key, next[key])
+			}
+		}
+	}
+}
+
+// The value of key, "" if it isn't set
+func (c *configStore) Get(key string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.values[key]
+}
+
+// Calls fn for every change to a key starting with prefix
+func (c *configStore) Subscribe(prefix string, fn func(key, value string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subs = append(c.subs, configSubscription{prefix, fn})
+}
@@ -3,16 +3,45 @@ package services
 import (
 	"errors"
 	"github.com/hashicorp/consul/api"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
+// Mirrors every key under Prefix, kept current by a blocking query once launched
 type ConsulConfigs struct {
-	Client    *api.Client
-	KV        *api.KV
-	RedisUrls string
+	configStore
+	Client *api.Client
+	KV     *api.KV
+	Prefix string
+	Wait   time.Duration
+
+	indexMu sync.Mutex
+	index   uint64
 }
 
+const DefaultConsulPrefix = "ms/"
+const DefaultConsulWait = 5 * time.Minute
+
 var KeyMissing = errors.New("Key Missing")
 
+func (c *ConsulConfigs) prefix() string {
+	if c.Prefix == "" {
+		return DefaultConsulPrefix
+	}
+	return c.Prefix
+}
+
+func (c *ConsulConfigs) wait() time.Duration {
+	if c.Wait <= 0 {
+		return DefaultConsulWait
+	}
+	return c.Wait
+}
+
+// Loads the prefix the first time, after that the watch started by Launch keeps it current
 func (c *ConsulConfigs) Cycle() error {
 	if c.Client == nil {
 		client, err := api.NewClient(api.DefaultConfig())
@@ -23,13 +52,89 @@ func (c *ConsulConfigs) Cycle() error {
 		c.KV = client.KV()
 	}
 
-	pair, _, err := c.KV.Get("ms/redis/urls", nil)
-	if err != nil {
-		return ErrAllowed{err}
+	if !c.loaded() {
+		pairs, meta, err := c.KV.List(c.prefix(), nil)
+		if err != nil {
+			return ErrAllowed{err}
+		}
+		c.apply(pairs, meta.LastIndex)
 	}
-	if pair == nil {
+	if c.empty() {
 		return ErrAllowed{KeyMissing}
 	}
-	c.RedisUrls = string(pair.Value)
 	return nil
 }
+
+// Watches the prefix with blocking queries, backing off while consul is unreachable
+func (c *ConsulConfigs) Launch(errs chan error) error {
+	if c.KV == nil {
+		return nil
+	}
+	go func() {
+		backoff := time.Second
+		for {
+			c.indexMu.Lock()
+			index := c.index
+			c.indexMu.Unlock()
+			pairs, meta, err := c.KV.List(c.prefix(), &api.QueryOptions{WaitIndex: index, WaitTime: c.wait()})
+			if err != nil {
+				errs <- ErrAllowed{err}
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > time.Minute {
+					backoff = time.Minute
+				}
+				continue
+			}
+			backoff = time.Second
+			c.apply(pairs, meta.LastIndex)
+		}
+	}()
+	return nil
+}
+
+func (c *ConsulConfigs) apply(pairs api.KVPairs, index uint64) {
+	next := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		next[pair.Key] = string(pair.Value)
+	}
+
+	c.indexMu.Lock()
+	// an index going backwards means consul was restored from a snapshot, start over
+	if index < c.index {
+		index = 0
+	}
+	c.index = index
+	c.indexMu.Unlock()
+
+	c.set(next)
+}
+
+// Writes key to consul, the watch then hands it to subscribers
+func (c *ConsulConfigs) Set(key, value string) error {
+	if c.KV == nil {
+		return KeyMissing
+	}
+	_, err := c.KV.Put(&api.KVPair{Key: key, Value: []byte(value)}, nil)
+	return err
+}
+
+// host:port of every passing instance of service, sorted so the list only changes when the instances do
+func (c *ConsulConfigs) Service(name string) ([]string, error) {
+	if c.Client == nil {
+		return nil, KeyMissing
+	}
+	entries, _, err := c.Client.Health().Service(name, "", true, nil)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{}
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)))
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
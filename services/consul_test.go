@@ -0,0 +1,46 @@
+package services
+
+import (
+	"github.com/hashicorp/consul/api"
+	"testing"
+)
+
+func TestConsulSubscribe(t *testing.T) {
+	c := &ConsulConfigs{}
+	changes := map[string]string{}
+	c.Subscribe("ms/redis/", func(key, value string) { changes[key] = value })
+
+	c.apply(api.KVPairs{{Key: "ms/redis/urls", Value: []byte("a:6379")}, {Key: "ms/keys/ring", Value: []byte("1:active")}}, 10)
+	if c.Get("ms/keys/ring") != "1:active" || len(changes) != 1 || changes["ms/redis/urls"] != "a:6379" {
+		t.Error("initial load wrong", changes)
+	}
+
+	changes = map[string]string{}
+	c.apply(api.KVPairs{{Key: "ms/redis/urls", Value: []byte("a:6379")}, {Key: "ms/redis/service", Value: []byte("recalls")}}, 12)
+	if len(changes) != 1 || changes["ms/redis/service"] != "recalls" {
+		t.Error("only the new key should be pushed", changes)
+	}
+
+	changes = map[string]string{}
+	c.apply(api.KVPairs{{Key: "ms/redis/service", Value: []byte("recalls")}}, 4)
+	if v, found := changes["ms/redis/urls"]; !found || v != "" || c.Get("ms/redis/urls") != "" {
+		t.Error("deletion not pushed", changes)
+	}
+	if c.index != 0 {
+		t.Error("index went backwards without resetting", c.index)
+	}
+}
+
+func TestCycleKick(t *testing.T) {
+	cycles := 0
+	c := &CycleService{}
+	c.Children = append(c.Children, &CycleService{Proxy: func() error { cycles++; return nil }})
+	c.Kick()
+	c.Kick()
+	if len(c.kicks()) != 1 {
+		t.Error("kicks should coalesce")
+	}
+	if err := c.cycleAll(); err != nil || cycles != 1 {
+		t.Error(cycles, err)
+	}
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"github.com/clixxa/dsp/bindings"
+	"sync"
 	"time"
 )
 
@@ -19,6 +20,22 @@ type CycleService struct {
 		Cycle() error
 	}
 	Proxy func() error
+
+	kickOnce sync.Once
+	kick     chan struct{}
+}
+
+func (c *CycleService) kicks() chan struct{} {
+	c.kickOnce.Do(func() { c.kick = make(chan struct{}, 1) })
+	return c.kick
+}
+
+// Cycles as soon as possible instead of waiting for the minute, kicks during a cycle coalesce into one more
+func (c *CycleService) Kick() {
+	select {
+	case c.kicks() <- struct{}{}:
+	default:
+	}
 }
 
 func (c *CycleService) Launch(errs chan error) error {
@@ -26,7 +43,12 @@ func (c *CycleService) Launch(errs chan error) error {
 		return err
 	}
 	go func() {
-		for range time.NewTicker(time.Minute).C {
+		ticker := time.NewTicker(time.Minute)
+		for {
+			select {
+			case <-ticker.C:
+			case <-c.kicks():
+			}
 			if err := c.cycleAll(); err != nil {
 				errs <- err
 			}
@@ -3,48 +3,156 @@ package services
 import (
 	"database/sql"
 	"github.com/clixxa/dsp/bindings"
-	"gopkg.in/redis.v5"
 	"log"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// Sampling for the bid audit log, see bindings.AuditSampling. Nothing is written unless TAUDITDIR is set.
+const AuditKey = "ms/audit"
+
 type ProductionDepsService struct {
 	BindingDeps bindings.BindingDeps
 	RedisStr    string
-	Consul      *ConsulConfigs
+	Shards      *bindings.ShardSystem
+	Memory      *bindings.MemoryCache
+	IDs         *bindings.Snowflake
+	Config      ConfigProvider
+	// leaves the databases unconnected and keeps recalls in memory when there's no redis, for running from a snapshot
+	Offline bool
+
+	configDump string
+	statsDump  string
 }
 
 func (p *ProductionDepsService) ConfigDSN() *bindings.DSN {
-	return &bindings.DSN{
+	return p.dsn("ms/configdb/", &bindings.DSN{
 		"mysql",
 		os.Getenv("TCONFIGDBHOST"),
 		os.Getenv("TCONFIGDBPORT"),
 		os.Getenv("TCONFIGDB"),
 		os.Getenv("TCONFIGDBUSERNAME"),
 		os.Getenv("TCONFIGDBPASSWORD"),
-	}
+	})
 }
 
 func (p *ProductionDepsService) StatsDSN() *bindings.DSN {
-	return &bindings.DSN{
+	return p.dsn("ms/statsdb/", &bindings.DSN{
 		"postgres",
 		os.Getenv("TSTATSDBHOST"),
 		os.Getenv("TSTATSDBPORT"),
 		os.Getenv("TSTATSDB"),
 		os.Getenv("TSTATSDBUSERNAME"),
 		os.Getenv("TSTATSDBPASSWORD"),
+	})
+}
+
+// Overrides d with consul's host, port, name, username and password keys under prefix. If prefix+"service"
+// names a consul service the host and port come from its first healthy instance instead.
+func (p *ProductionDepsService) dsn(prefix string, d *bindings.DSN) *bindings.DSN {
+	for _, kv := range []struct {
+		key  string
+		dest *string
+	}{{"host", &d.Host}, {"port", &d.Port}, {"name", &d.Database}, {"username", &d.Username}, {"password", &d.Password}} {
+		if v := p.Config.Get(prefix + kv.key); v != "" {
+			*kv.dest = v
+		}
+	}
+	if name := p.Config.Get(prefix + "service"); name != "" {
+		addrs, err := p.Config.Service(name)
+		if err == nil && len(addrs) > 0 {
+			d.Host, d.Port, _ = net.SplitHostPort(addrs[0])
+		} else {
+			p.BindingDeps.Logger.Println("no healthy instances of", name, err)
+		}
 	}
+	return d
 }
 
+// Healthy instances of the ms/redis/service service, then ms/redis/urls, then the environment
 func (p *ProductionDepsService) RedisDSN() string {
-	if p.Consul.RedisUrls != "" {
-		return p.Consul.RedisUrls
+	if name := p.Config.Get("ms/redis/service"); name != "" {
+		addrs, err := p.Config.Service(name)
+		if err == nil && len(addrs) > 0 {
+			return strings.Join(addrs, ",")
+		}
+		p.BindingDeps.Logger.Println("no healthy instances of", name, err)
+	}
+	if str := p.Config.Get("ms/redis/urls"); str != "" {
+		return str
 	}
 	return os.Getenv("TRECALLURL")
 }
 
+func (p *ProductionDepsService) RecallTTLDSN() string {
+	if str := p.Config.Get("ms/recalls/ttl"); str != "" {
+		return str
+	}
+	return os.Getenv("TRECALLTTL")
+}
+
+func (p *ProductionDepsService) KeyringDSN() string {
+	if str := p.Config.Get("ms/keys/ring"); str != "" {
+		return str
+	}
+	return os.Getenv("TKEYRING")
+}
+
+// (Re)connects when the dsn changes, closing the replaced pool once requests still using it are done.
+// Connections that were handed in rather than made here are left alone.
+func (p *ProductionDepsService) connect(dsn *bindings.DSN, current *string, db **sql.DB) error {
+	dump := dsn.Dump()
+	if *db != nil && (*current == "" || *current == dump) {
+		return nil
+	}
+	p.BindingDeps.Debug.Println("connecting to", dsn.String())
+	next, err := sql.Open(dsn.Driver, dump)
+	if err == nil {
+		if err = next.Ping(); err != nil {
+			next.Close()
+		}
+	}
+	if err != nil {
+		p.BindingDeps.Debug.Println("err:", err.Error())
+		if *db != nil {
+			return ErrAllowed{err}
+		}
+		return err
+	}
+	if old := *db; old != nil {
+		go func() {
+			time.Sleep(time.Minute)
+			old.Close()
+		}()
+	}
+	*db, *current = next, dump
+	return nil
+}
+
+// Validates the keys up front, keeping the last good ones if a rotation is malformed
+func (p *ProductionDepsService) cycleKeys() error {
+	legacy, err := bindings.ParseLegacyKey(p.BindingDeps.DefaultKey)
+	var ring *bindings.Keyring
+	if err == nil {
+		ring, err = bindings.ParseKeyring(p.KeyringDSN())
+	}
+	if err == nil {
+		err = ring.Validate()
+	}
+	if err != nil {
+		if p.BindingDeps.DefaultTokens != nil {
+			p.BindingDeps.Logger.Println("keys invalid, keeping the previous ones:", err.Error())
+			return nil
+		}
+		return err
+	}
+	p.BindingDeps.DefaultTokens = ring.Codec(legacy)
+	return nil
+}
+
 func (p *ProductionDepsService) Cycle() error {
 	if p.BindingDeps.Debug == nil {
 		p.BindingDeps.Debug = log.New(os.Stderr, "", log.Lshortfile|log.Ltime)
@@ -58,61 +166,114 @@ func (p *ProductionDepsService) Cycle() error {
 	if p.BindingDeps.DefaultKey == "" {
 		p.BindingDeps.DefaultKey = os.Getenv("TDEFAULTKEY")
 	}
+	p.BindingDeps.CompressRecalls = os.Getenv("TRECALLCOMPRESS") == "1"
+
+	if ttls, err := bindings.ParseRecallTTLs(p.RecallTTLDSN()); err != nil {
+		p.BindingDeps.Logger.Println("recall ttls invalid, keeping the previous ones:", err.Error())
+	} else {
+		p.BindingDeps.RecallTTLs = ttls
+	}
+
+	if sw, err := bindings.ParseSwitches(p.Config.Get(SwitchesKey)); err != nil {
+		p.BindingDeps.Logger.Println("switches invalid, keeping the previous ones:", err.Error())
+	} else {
+		p.BindingDeps.Switches = sw
+	}
+
+	if a, err := bindings.ParseAuditSampling(p.Config.Get(AuditKey)); err != nil {
+		p.BindingDeps.Logger.Println("audit sampling invalid, keeping the previous one:", err.Error())
+	} else {
+		p.BindingDeps.AuditSampling = a
+	}
+	if p.BindingDeps.Audit == nil && os.Getenv("TAUDITDIR") != "" {
+		p.BindingDeps.Audit = &bindings.AuditLog{Dir: os.Getenv("TAUDITDIR")}
+		p.BindingDeps.Audit.MaxBytes, _ = strconv.ParseInt(os.Getenv("TAUDITMAXBYTES"), 10, 64)
+		p.BindingDeps.Audit.MaxFiles, _ = strconv.Atoi(os.Getenv("TAUDITMAXFILES"))
+	}
+
+	if err := p.cycleKeys(); err != nil {
+		p.BindingDeps.Debug.Println("err:", err.Error())
+		return err
+	}
 
 	if p.BindingDeps.Redis != nil {
 		go func(oldredis *bindings.RandomCache) {
 			time.Sleep(4 * time.Second)
 			s := p.BindingDeps.Redis.String()
 			if s != "" {
-				p.BindingDeps.Logger.Println("redis dump")
+				p.BindingDeps.Logger.Println("redis dump", s)
 			}
 		}(p.BindingDeps.Redis)
 	}
 
+	if p.IDs == nil {
+		if str := os.Getenv("TINSTANCEID"); str != "" {
+			n, err := strconv.Atoi(str)
+			if err == nil {
+				p.IDs, err = bindings.NewSnowflake(n)
+			}
+			if err != nil {
+				p.BindingDeps.Debug.Println("err:", err.Error())
+				return err
+			}
+		} else {
+			p.IDs = bindings.RandomSnowflake()
+			p.BindingDeps.Logger.Println("TINSTANCEID not set, recall ids using random instance", p.IDs.Instance)
+		}
+	}
+
 	if str := p.RedisDSN(); str != p.RedisStr {
 		p.RedisStr = str
-		sh := &bindings.ShardSystem{Fallback: p.BindingDeps.Redis}
+		sh := &bindings.ShardSystem{}
+		sh.Replicas, _ = strconv.Atoi(os.Getenv("TRECALLREPLICAS"))
+		sh.WriteQuorum, _ = strconv.Atoi(os.Getenv("TRECALLQUORUM"))
+		if p.Shards != nil {
+			sh.Previous = p.Shards.WithoutHistory()
+			// a replaced ring keeps serving misses until everything on it has expired
+			sh.PreviousUntil = time.Now().Add(p.BindingDeps.RecallTTLs.Max())
+		}
 		for _, url := range strings.Split(str, ",") {
-			red := &redis.Options{Addr: url}
-			r := &bindings.RecallRedis{Client: redis.NewClient(red)}
+			conf, err := bindings.ParseRedisURL(url)
+			if err != nil {
+				p.BindingDeps.Debug.Println("err:", err.Error())
+				return err
+			}
+			r := &bindings.RecallRedis{Cmdable: conf.Client()}
 			sh.Children = append(sh.Children, r)
+			sh.Names = append(sh.Names, conf.String())
 			if err := r.Ping().Err(); err != nil {
 				return err
 			}
 		}
-		rc2 := &bindings.RandomCache{sh}
+		p.Shards = sh
+		var cache bindings.CacheSystem = sh
+		if p.Memory == nil && os.Getenv("TRECALLMEMENTRIES") != "0" {
+			p.Memory = &bindings.MemoryCache{}
+			p.Memory.MaxEntries, _ = strconv.Atoi(os.Getenv("TRECALLMEMENTRIES"))
+			p.Memory.MaxBytes, _ = strconv.Atoi(os.Getenv("TRECALLMEMBYTES"))
+		}
+		if p.Memory != nil {
+			cache = &bindings.WriteThrough{Memory: p.Memory, Backing: sh}
+		}
+		rc2 := &bindings.RandomCache{CacheSystem: cache, IDs: p.IDs}
 		p.BindingDeps.Redis = rc2
 
 	}
 
-	if p.BindingDeps.ConfigDB == nil {
-		p.BindingDeps.Debug.Println("connecting to real config")
-		dsn := p.ConfigDSN()
-		db, err := sql.Open(dsn.Driver, dsn.Dump())
-		if err != nil {
-			p.BindingDeps.Debug.Println("err:", err.Error())
-			return err
-		}
-		if err := db.Ping(); err != nil {
-			p.BindingDeps.Debug.Println("err:", err.Error())
-			return err
+	if p.Offline {
+		if p.BindingDeps.Redis == nil {
+			p.Memory = &bindings.MemoryCache{}
+			p.BindingDeps.Redis = &bindings.RandomCache{CacheSystem: p.Memory, IDs: p.IDs}
+			p.BindingDeps.Logger.Println("offline without redis, recalls are kept in memory")
 		}
-		p.BindingDeps.ConfigDB = db
+		return nil
 	}
 
-	if p.BindingDeps.StatsDB == nil {
-		p.BindingDeps.Debug.Println("connecting to real stats")
-		dsn := p.StatsDSN()
-		db, err := sql.Open(dsn.Driver, dsn.Dump())
-		if err != nil {
-			p.BindingDeps.Debug.Println("err:", err.Error())
-			return err
-		}
-		if err := db.Ping(); err != nil {
-			p.BindingDeps.Debug.Println("err:", err.Error())
-			return err
-		}
-		p.BindingDeps.StatsDB = db
+	if err := p.connect(p.ConfigDSN(), &p.configDump, &p.BindingDeps.ConfigDB); err != nil {
+		return err
+	}
+	if err := p.connect(p.StatsDSN(), &p.statsDump, &p.BindingDeps.StatsDB); err != nil {
+		return err
 	}
 	return nil
 }
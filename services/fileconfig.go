@@ -0,0 +1,134 @@
+package services
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reads the keys from a JSON file for local development, eg
+//
+//	{"ms": {"redis": {"urls": "localhost:6379"}, "keys": {"ring": ""}}, "services": {"stats": "localhost:5432"}}
+//
+// Nested objects are joined with "/" so that's the key ms/redis/urls. Service(name) reads the comma separated
+// addresses at services/{name}. The file is polled for changes once launched.
+type FileConfigs struct {
+	configStore
+	Path string
+	Poll time.Duration
+
+	mu        sync.Mutex
+	modTime   time.Time
+	size      int64
+	overrides map[string]string
+}
+
+const DefaultFilePoll = 2 * time.Second
+
+func (f *FileConfigs) poll() time.Duration {
+	if f.Poll <= 0 {
+		return DefaultFilePoll
+	}
+	return f.Poll
+}
+
+// Rereads the file if it has been modified since the last read. Once loaded, a bad edit keeps the previous keys.
+func (f *FileConfigs) Cycle() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.read()
+	if err != nil && f.loaded() {
+		return ErrAllowed{err}
+	}
+	return err
+}
+
+func (f *FileConfigs) read() error {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	if f.loaded() && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil
+	}
+	d, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	values, err := flattenConfig(d)
+	if err != nil {
+		return err
+	}
+	f.modTime, f.size = info.ModTime(), info.Size()
+	for key, val := range f.overrides {
+		values[key] = val
+	}
+	f.set(values)
+	return nil
+}
+
+// Keeps value in memory over whatever the file says, it isn't written back
+func (f *FileConfigs) Set(key, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.overrides == nil {
+		f.overrides = map[string]string{}
+	}
+	f.overrides[key] = value
+
+	f.configStore.mu.RLock()
+	values := make(map[string]string, len(f.values)+1)
+	for k, v := range f.values {
+		values[k] = v
+	}
+	f.configStore.mu.RUnlock()
+	values[key] = value
+	f.set(values)
+	return nil
+}
+
+func (f *FileConfigs) Launch(errs chan error) error {
+	go func() {
+		for range time.NewTicker(f.poll()).C {
+			if err := f.Cycle(); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	return nil
+}
+
+func (f *FileConfigs) Service(name string) ([]string, error) {
+	str := f.Get("services/" + name)
+	if str == "" {
+		return nil, KeyMissing
+	}
+	return strings.Split(str, ","), nil
+}
+
+func flattenConfig(d []byte) (map[string]string, error) {
+	var tree map[string]interface{}
+	if err := json.Unmarshal(d, &tree); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	var walk func(prefix string, node map[string]interface{})
+	walk = func(prefix string, node map[string]interface{}) {
+		for key, val := range node {
+			switch v := val.(type) {
+			case map[string]interface{}:
+				walk(prefix+key+"/", v)
+			case string:
+				values[prefix+key] = v
+			default:
+				js, _ := json.Marshal(v)
+				values[prefix+key] = string(js)
+			}
+		}
+	}
+	walk("", tree)
+	return values, nil
+}
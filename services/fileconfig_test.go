@@ -0,0 +1,44 @@
+package services
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileConfigs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dspconfig")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(path, []byte(`{"ms": {"redis": {"urls": "localhost:6379"}, "recalls": {"ttl": "1h"}}, "services": {"stats": "a:5432,b:5432"}}`), 0644)
+
+	f := &FileConfigs{Path: path}
+	var provider ConfigProvider = f
+	changes := map[string]string{}
+	provider.Subscribe("ms/redis/", func(key, value string) { changes[key] = value })
+	if err := provider.Cycle(); err != nil {
+		t.Fatal(err)
+	}
+	if f.Get("ms/recalls/ttl") != "1h" || changes["ms/redis/urls"] != "localhost:6379" {
+		t.Error("nested keys not flattened", changes)
+	}
+	if addrs, err := f.Service("stats"); err != nil || len(addrs) != 2 || addrs[1] != "b:5432" {
+		t.Error("bad service", addrs, err)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"ms/redis/urls": "other:6379"}`), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if err := f.Cycle(); err != nil || changes["ms/redis/urls"] != "other:6379" {
+		t.Error("change not picked up", changes, err)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"ms/redis/urls": `), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	if err := f.Cycle(); err == nil {
+		t.Error("expected a parse error")
+	} else if _, allowed := err.(ErrAllowed); !allowed || f.Get("ms/redis/urls") != "other:6379" {
+		t.Error("bad edit should keep the previous keys", err)
+	}
+}
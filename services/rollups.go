@@ -0,0 +1,62 @@
+package services
+
+import (
+	"github.com/clixxa/dsp/bindings"
+	"os"
+	"time"
+)
+
+const RetentionKey = "ms/stats/retention"
+const TrailingKey = "ms/stats/trailing"
+
+// How often the rollups run unless Interval says otherwise
+const DefaultRollupInterval = 5 * time.Minute
+
+// Runs bindings.Rollups from the cycler every Interval. Retention and trailing hours are durations
+// (eg "2160h") read from the config keys above, or TPURCHASESRETENTION for the retention.
+type RollupService struct {
+	BindingDeps bindings.BindingDeps
+	Config      ConfigProvider
+	Interval    time.Duration
+
+	last time.Time
+}
+
+func (r *RollupService) duration(key, env string) time.Duration {
+	s := r.Config.Get(key)
+	if s == "" && env != "" {
+		s = os.Getenv(env)
+	}
+	if s == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		r.BindingDeps.Logger.Println("ignoring invalid", key, err.Error())
+		return 0
+	}
+	return d
+}
+
+// Failures are logged and allowed, the next run covers the same hours again
+func (r *RollupService) Cycle() error {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = DefaultRollupInterval
+	}
+	now := time.Now()
+	if now.Sub(r.last) < interval {
+		return nil
+	}
+	r.last = now
+
+	rollups := bindings.Rollups{
+		Env:       r.BindingDeps,
+		Trailing:  r.duration(TrailingKey, ""),
+		Retention: r.duration(RetentionKey, "TPURCHASESRETENTION"),
+	}
+	if _, _, err := rollups.Aggregate(now); err != nil {
+		return ErrAllowed{err}
+	}
+	return nil
+}
@@ -1,7 +1,7 @@
 package wish_flights
 
 import (
-	"encoding/json"
+	"encoding"
 	"fmt"
 	"github.com/clixxa/dsp/bindings"
 	"github.com/clixxa/dsp/dsp_flights"
@@ -20,6 +20,12 @@ type WishEntrypoint struct {
 	BindingDeps bindings.BindingDeps
 
 	AllTest bool
+	// log purchases and orphans instead of saving them, for running without StatsDB
+	SkipWork bool
+
+	// since the last cycle
+	wins    uint64
+	orphans uint64
 }
 
 func (e *WishEntrypoint) Cycle() error {
@@ -33,8 +39,16 @@ func (e *WishEntrypoint) Cycle() error {
 		wf.Runtime.Logger.Println("brand new runtime")
 		wf.Runtime.Debug = e.BindingDeps.Debug
 
-		wf.Runtime.Storage.Recall = bindings.Recalls{Env: e.BindingDeps}.Fetch
-		wf.Runtime.Storage.Purchases = bindings.Purchases{Env: e.BindingDeps}.Save
+		wf.Runtime.Storage.Purchases = bindings.Purchases{Env: e.BindingDeps, SkipWork: e.SkipWork}.Save
+		wf.Runtime.Storage.Orphans = bindings.OrphanWins{Env: e.BindingDeps, SkipWork: e.SkipWork}.Save
+		wf.Runtime.Wins, wf.Runtime.Orphans = &e.wins, &e.orphans
+	}
+	// the redis ring can change between cycles
+	wf.Runtime.Storage.Recall = bindings.Recalls{Env: e.BindingDeps}.Fetch
+
+	wins, orphans := atomic.SwapUint64(&e.wins, 0), atomic.SwapUint64(&e.orphans, 0)
+	if wins > 0 {
+		e.BindingDeps.Logger.Printf(`orphan wins %d of %d (%.2f%%) since last cycle`, orphans, wins, 100*float64(orphans)/float64(wins))
 	}
 
 	e.winFlight.Store(wf)
@@ -58,11 +72,15 @@ func (e *WishEntrypoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 type WinFlight struct {
 	Runtime struct {
 		Storage struct {
-			Purchases func([17]interface{}, *error)
-			Recall    func(json.Unmarshaler, *error, string)
+			Purchases func([18]interface{}, *error)
+			Recall    func(encoding.BinaryUnmarshaler, *error, string)
+			Orphans   func([5]interface{}, *error)
 		}
 		Logger *log.Logger
 		Debug  *log.Logger
+
+		Wins    *uint64
+		Orphans *uint64
 	} `json:"-"`
 
 	HttpRequest  *http.Request       `json:"-"`
@@ -72,12 +90,15 @@ type WinFlight struct {
 	CreativeID int                 `json:"creative"`
 	Request    dsp_flights.Request `json:"req"`
 	Margin     int                 `json:"margin"`
+	SspID      int                 `json:"ssp"`
 	StartTime  time.Time
 
 	RevTXHome int    `json:"-"`
 	PaidPrice int    `json:"-"`
 	RecallID  string `json:"-"`
 	SaleID    int    `json:"-"`
+	RawQuery  string `json:"-"`
+	Orphan    bool   `json:"-"`
 
 	Error error `json:"-"`
 }
@@ -103,14 +124,23 @@ func (wf *WinFlight) Launch() {
 	WriteWinResponse(wf)
 }
 
-func (wf *WinFlight) Columns() [17]interface{} {
-	return [17]interface{}{wf.SaleID, !wf.Request.RawRequest.Test, wf.RevTXHome, wf.RevTXHome, wf.PaidPrice, wf.PaidPrice, 0, wf.FolderID, wf.CreativeID, wf.Request.CountryID, wf.Request.VerticalID, wf.Request.BrandID, wf.Request.NetworkID, wf.Request.SubNetworkID, wf.Request.NetworkTypeID, wf.Request.GenderID, wf.Request.DeviceTypeID}
+func (wf *WinFlight) Columns() [18]interface{} {
+	recallID, _ := strconv.ParseInt(wf.RecallID, 10, 64)
+	return [18]interface{}{wf.SaleID, !wf.Request.RawRequest.Test, wf.RevTXHome, wf.RevTXHome, wf.PaidPrice, wf.PaidPrice, wf.SspID, wf.FolderID, wf.CreativeID, wf.Request.CountryID, wf.Request.VerticalID, wf.Request.BrandID, wf.Request.NetworkID, wf.Request.SubNetworkID, wf.Request.NetworkTypeID, wf.Request.GenderID, wf.Request.DeviceTypeID, recallID}
 }
 
-type wfProxy WinFlight
-
-func (wf *WinFlight) UnmarshalJSON(d []byte) error {
-	return json.Unmarshal(d, (*wfProxy)(wf))
+// Decodes the recall the bid saved, see dsp_flights.DemandFlight.MarshalBinary
+func (wf *WinFlight) UnmarshalBinary(d []byte) error {
+	df := &dsp_flights.DemandFlight{}
+	if err := df.UnmarshalBinary(d); err != nil {
+		return err
+	}
+	wf.FolderID, wf.CreativeID, wf.Margin, wf.Request = df.FolderID, df.CreativeID, df.Margin, df.Request
+	// recalls from before v2 don't have the ssp, keep the one from the win url
+	if df.SspID != 0 {
+		wf.SspID = df.SspID
+	}
+	return nil
 }
 
 func ReadWinNotice(flight *WinFlight) {
@@ -120,6 +150,8 @@ func ReadWinNotice(flight *WinFlight) {
 	if u, e := url.ParseRequestURI(flight.HttpRequest.RequestURI); e != nil {
 		flight.Runtime.Logger.Println(`win url not valid`, e.Error())
 	} else {
+		flight.RawQuery = u.RawQuery
+		flight.SspID, _ = strconv.Atoi(u.Query().Get("ssp"))
 		flight.RecallID = u.Query().Get("key")
 		flight.Runtime.Logger.Printf(`got recallid %s`, flight.RecallID)
 
@@ -150,6 +182,12 @@ func ProcessWin(flight *WinFlight) {
 
 	flight.Runtime.Logger.Printf(`getting bid info for %d`, flight.RecallID)
 	flight.Runtime.Storage.Recall(flight, &flight.Error, flight.RecallID)
+	atomic.AddUint64(flight.Runtime.Wins, 1)
+	bindings.WinMetrics.Add("wins", 1)
+	if flight.Error == bindings.RecallMissingErr {
+		RecordOrphan(flight)
+		return
+	}
 	flight.RevTXHome = flight.PaidPrice + flight.Margin
 
 	flight.Runtime.Logger.Printf(`adding margin of %d to paid price of %d`, flight.Margin, flight.PaidPrice)
@@ -158,6 +196,19 @@ func ProcessWin(flight *WinFlight) {
 	flight.Runtime.Storage.Purchases(flight.Columns(), &flight.Error)
 }
 
+// The recall expired or never existed so the win can't be attributed, keep it for reconciling instead of failing
+func RecordOrphan(flight *WinFlight) {
+	flight.Error = nil
+	flight.Orphan = true
+	atomic.AddUint64(flight.Runtime.Orphans, 1)
+	bindings.WinMetrics.Add("orphans", 1)
+	bindings.WinMetrics.Add(`orphans_ssp_`+strconv.Itoa(flight.SspID), 1)
+
+	recallID, _ := strconv.ParseInt(flight.RecallID, 10, 64)
+	flight.Runtime.Logger.Printf(`recall %s missing, recording orphan win`, flight.RecallID)
+	flight.Runtime.Storage.Orphans([5]interface{}{recallID, flight.SspID, flight.SaleID, flight.PaidPrice, flight.RawQuery}, &flight.Error)
+}
+
 func WriteWinResponse(flight *WinFlight) {
 	if flight.Error != nil {
 		flight.Runtime.Logger.Printf(`!! got an error handling win notice !! %s !!`, flight.Error.Error())
@@ -0,0 +1,75 @@
+package wish_flights
+
+import (
+	"encoding"
+	"github.com/clixxa/dsp/bindings"
+	"github.com/clixxa/dsp/dsp_flights"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOrphanWin(t *testing.T) {
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+
+	var wins, orphans uint64
+	flight := &WinFlight{}
+	flight.Runtime.Logger, flight.Runtime.Debug = l, l
+	flight.Runtime.Wins, flight.Runtime.Orphans = &wins, &orphans
+	flight.Runtime.Storage.Recall = func(f encoding.BinaryUnmarshaler, err *error, id string) {
+		*err = bindings.RecallMissingErr
+	}
+	flight.Runtime.Storage.Purchases = func(cols [18]interface{}, err *error) {
+		t.Error("orphan shouldn't be billed as a purchase")
+	}
+	var saved [5]interface{}
+	flight.Runtime.Storage.Orphans = func(cols [5]interface{}, err *error) { saved = cols }
+
+	flight.HttpRequest = httptest.NewRequest("GET", "/win?price=300&key=55&imp=8&ssp=4", nil)
+	rec := httptest.NewRecorder()
+	flight.HttpResponse = rec
+	flight.Launch()
+
+	if rec.Code != 200 || !flight.Orphan {
+		t.Error("expected an orphan 200, got", rec.Code, flight.String())
+	}
+	if saved != [5]interface{}{int64(55), 4, 8, 300, "price=300&key=55&imp=8&ssp=4"} {
+		t.Error("unexpected orphan columns", saved)
+	}
+	if wins != 1 || orphans != 1 {
+		t.Error("orphan not counted", wins, orphans)
+	}
+}
+
+func TestWinFromRecall(t *testing.T) {
+	l, fin := bindings.BufferedLogger(t)
+	defer fin()
+
+	df := &dsp_flights.DemandFlight{FolderID: 3, CreativeID: 5, Margin: 20, SspID: 4}
+	recall, _ := df.MarshalBinary()
+
+	var wins, orphans uint64
+	flight := &WinFlight{}
+	flight.Runtime.Logger, flight.Runtime.Debug = l, l
+	flight.Runtime.Wins, flight.Runtime.Orphans = &wins, &orphans
+	flight.Runtime.Storage.Recall = func(f encoding.BinaryUnmarshaler, err *error, id string) {
+		*err = f.UnmarshalBinary(recall)
+	}
+	var cols [18]interface{}
+	flight.Runtime.Storage.Purchases = func(c [18]interface{}, err *error) { cols = c }
+
+	flight.HttpRequest = httptest.NewRequest("GET", "/win?price=300&key=55&imp=8", nil)
+	rec := httptest.NewRecorder()
+	flight.HttpResponse = rec
+	flight.Launch()
+
+	if rec.Code != 200 || flight.Orphan {
+		t.Error("expected a billed win, got", rec.Code, flight.String())
+	}
+	if cols[2] != 320 || cols[6] != 4 || cols[7] != 3 || cols[17] != int64(55) {
+		t.Error("unexpected purchase columns", cols)
+	}
+	if wins != 1 || orphans != 0 {
+		t.Error("wrong counts", wins, orphans)
+	}
+}